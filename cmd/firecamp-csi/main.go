@@ -0,0 +1,72 @@
+// Command firecamp-csi runs the firecamp CSI plugin, exposing
+// firecamp-managed EBS volumes as CSI-compliant persistent volumes so
+// Kubernetes (or any other CSI-compliant orchestrator) can consume them
+// instead of only ECS/Swarm.
+package main
+
+import (
+	"flag"
+	"net"
+	"os"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"google.golang.org/grpc"
+
+	"github.com/cloudstax/openmanage/csi"
+	csiaws "github.com/cloudstax/openmanage/csi/aws"
+	"github.com/cloudstax/openmanage/db"
+)
+
+// defaultDriverName follows the reverse-DNS convention CSI drivers use, so
+// it does not collide with other vendors' plugins registered on the node.
+const defaultDriverName = "csi.firecamp.openmanage.io"
+
+const driverVersion = "0.1.0"
+
+var (
+	drivername = flag.String("drivername", defaultDriverName, "name the CSI plugin registers as")
+	endpoint   = flag.String("endpoint", "unix:///var/lib/kubelet/plugins/"+defaultDriverName+"/csi.sock", "CSI endpoint")
+	cluster    = flag.String("cluster", "", "the firecamp cluster name")
+	nodeID     = flag.String("nodeid", "", "the id of the node this plugin instance runs on")
+	region     = flag.String("region", "", "the AWS region to create EBS volumes in")
+	dataDir    = flag.String("datadir", "/var/lib/firecamp-csi", "the directory to persist volume/device state in, so it survives a plugin restart")
+)
+
+func main() {
+	flag.Parse()
+
+	if len(*cluster) == 0 {
+		glog.Errorln("cluster name is required")
+		os.Exit(1)
+	}
+
+	dbIns, err := db.NewPersistMemDB(*dataDir)
+	if err != nil {
+		glog.Fatalln("create persistent db at", *dataDir, "error", err)
+	}
+
+	sess, err := session.NewSession()
+	if err != nil {
+		glog.Fatalln("create aws session error", err)
+	}
+	ebs := csiaws.NewEBSVolumes(ec2.New(sess, aws.NewConfig().WithRegion(*region)))
+
+	lis, err := net.Listen("unix", (*endpoint)[len("unix://"):])
+	if err != nil {
+		glog.Fatalln("listen on", *endpoint, "error", err)
+	}
+
+	s := grpc.NewServer()
+	csipb.RegisterIdentityServer(s, csi.NewIdentityServer(*drivername, driverVersion))
+	csipb.RegisterControllerServer(s, csi.NewControllerServer(*cluster, dbIns, ebs))
+	csipb.RegisterNodeServer(s, csi.NewNodeServer(*cluster, *nodeID, dbIns))
+
+	glog.Infoln("firecamp-csi", *drivername, "listening on", *endpoint)
+	if err := s.Serve(lis); err != nil {
+		glog.Fatalln("serve error", err)
+	}
+}
@@ -0,0 +1,72 @@
+// Package aws implements csi.EBS on top of the AWS EC2 API, so the CSI
+// Controller service can create, delete, attach and detach the EBS volumes
+// backing firecamp's CSI persistent volumes.
+package aws
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"golang.org/x/net/context"
+)
+
+// defaultVolumeType is the EBS volume type firecamp creates volumes as.
+const defaultVolumeType = "gp2"
+
+// EBSVolumes implements csi.EBS against the AWS EC2 API.
+type EBSVolumes struct {
+	client *ec2.EC2
+}
+
+// NewEBSVolumes creates an EC2-backed csi.EBS.
+func NewEBSVolumes(client *ec2.EC2) *EBSVolumes {
+	return &EBSVolumes{client: client}
+}
+
+// CreateVolume creates a new gp2 EBS volume in az and returns its volume id.
+func (e *EBSVolumes) CreateVolume(ctx context.Context, az string, sizeGB int64) (string, error) {
+	resp, err := e.client.CreateVolume(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String(az),
+		Size:             aws.Int64(sizeGB),
+		VolumeType:       aws.String(defaultVolumeType),
+	})
+	if err != nil {
+		return "", fmt.Errorf("ec2 CreateVolume error %s", err)
+	}
+	return aws.StringValue(resp.VolumeId), nil
+}
+
+// DeleteVolume deletes the EBS volume.
+func (e *EBSVolumes) DeleteVolume(ctx context.Context, ebsVolumeID string) error {
+	if _, err := e.client.DeleteVolume(&ec2.DeleteVolumeInput{VolumeId: aws.String(ebsVolumeID)}); err != nil {
+		return fmt.Errorf("ec2 DeleteVolume %s error %s", ebsVolumeID, err)
+	}
+	return nil
+}
+
+// AttachVolume attaches the EBS volume to serverInstanceID at device.
+func (e *EBSVolumes) AttachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error {
+	_, err := e.client.AttachVolume(&ec2.AttachVolumeInput{
+		VolumeId:   aws.String(ebsVolumeID),
+		InstanceId: aws.String(serverInstanceID),
+		Device:     aws.String(device),
+	})
+	if err != nil {
+		return fmt.Errorf("ec2 AttachVolume %s to %s error %s", ebsVolumeID, serverInstanceID, err)
+	}
+	return nil
+}
+
+// DetachVolume detaches the EBS volume from serverInstanceID.
+func (e *EBSVolumes) DetachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error {
+	_, err := e.client.DetachVolume(&ec2.DetachVolumeInput{
+		VolumeId:   aws.String(ebsVolumeID),
+		InstanceId: aws.String(serverInstanceID),
+		Device:     aws.String(device),
+	})
+	if err != nil {
+		return fmt.Errorf("ec2 DetachVolume %s from %s error %s", ebsVolumeID, serverInstanceID, err)
+	}
+	return nil
+}
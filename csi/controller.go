@@ -0,0 +1,272 @@
+package csi
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cloudstax/openmanage/common"
+	"github.com/cloudstax/openmanage/db"
+)
+
+// giB is one gibibyte, the unit firecamp volumes are sized in.
+const giB = 1024 * 1024 * 1024
+
+// deviceNameCandidates are the device names ControllerPublishVolume tries,
+// in order, when allocating an attach point for a volume - the same naming
+// scheme EBS exposes attached block devices under on Linux.
+var deviceNameCandidates = buildDeviceNameCandidates()
+
+func buildDeviceNameCandidates() []string {
+	var names []string
+	for c := 'f'; c <= 'z'; c++ {
+		names = append(names, fmt.Sprintf("/dev/xvd%c", c))
+	}
+	return names
+}
+
+// EBS abstracts the cloud calls needed to back a CSI volume with an EBS
+// volume. It intentionally only covers what the Controller service needs;
+// attach-point (device name) selection stays local, through
+// MemDB.CreateDevice/DeleteDevice, rather than asking the cloud.
+type EBS interface {
+	CreateVolume(ctx context.Context, az string, sizeGB int64) (ebsVolumeID string, err error)
+	DeleteVolume(ctx context.Context, ebsVolumeID string) error
+	AttachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error
+	DetachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error
+}
+
+// ControllerServer implements the CSI Controller service on top of
+// firecamp's db.DB and EBS abstractions.
+type ControllerServer struct {
+	clusterName string
+	dbIns       db.DB
+	ebs         EBS
+}
+
+// NewControllerServer creates the CSI Controller service.
+func NewControllerServer(clusterName string, dbIns db.DB, ebs EBS) *ControllerServer {
+	return &ControllerServer{clusterName: clusterName, dbIns: dbIns, ebs: ebs}
+}
+
+// ControllerGetCapabilities reports the operations this Controller
+// implements.
+func (s *ControllerServer) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	types := []csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	}
+
+	caps := make([]*csi.ControllerServiceCapability, len(types))
+	for i, t := range types {
+		caps[i] = &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{Type: t},
+			},
+		}
+	}
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// CreateVolume creates a firecamp-managed EBS volume and records it in the
+// DB, keyed by the CSI volume name.
+func (s *ControllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	name := req.GetName()
+	if len(name) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume name required")
+	}
+
+	sizeBytes := req.GetCapacityRange().GetRequiredBytes()
+	sizeGB := (sizeBytes + giB - 1) / giB
+
+	az := pickZone(req.GetAccessibilityRequirements())
+
+	if existing, err := s.dbIns.GetVolumeByID(ctx, name); err == nil {
+		return &csi.CreateVolumeResponse{
+			Volume: &csi.Volume{
+				VolumeId:      newVolumeID(s.clusterName, existing.AvailableZone, name).String(),
+				CapacityBytes: sizeBytes,
+			},
+		}, nil
+	}
+
+	ebsVolumeID, err := s.ebs.CreateVolume(ctx, az, sizeGB)
+	if err != nil {
+		glog.Errorln("create ebs volume error", err, "name", name)
+		return nil, status.Errorf(codes.Internal, "create ebs volume error %s", err)
+	}
+
+	vol := &common.Volume{
+		ServiceUUID:   s.clusterName,
+		VolumeID:      name,
+		AvailableZone: az,
+	}
+	if err := s.dbIns.CreateVolume(ctx, vol); err != nil {
+		glog.Errorln("create volume in db error", err, "name", name)
+		return nil, status.Errorf(codes.Internal, "create volume record error %s", err)
+	}
+
+	return &csi.CreateVolumeResponse{
+		Volume: &csi.Volume{
+			VolumeId:      newVolumeID(s.clusterName, az, name).String(),
+			CapacityBytes: sizeGB * giB,
+		},
+	}, nil
+}
+
+// DeleteVolume deletes the EBS volume and its DB record.
+func (s *ControllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+	vol, err := s.resolveVolume(ctx, req.GetVolumeId())
+	if err == db.ErrDBRecordNotFound {
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "resolve volume error %s", err)
+	}
+
+	if err := s.ebs.DeleteVolume(ctx, vol.VolumeID); err != nil {
+		glog.Errorln("delete ebs volume error", err, "volume", vol.VolumeID)
+		return nil, status.Errorf(codes.Internal, "delete ebs volume error %s", err)
+	}
+
+	if err := s.dbIns.DeleteVolume(ctx, vol.ServiceUUID, vol.VolumeID); err != nil && err != db.ErrDBRecordNotFound {
+		return nil, status.Errorf(codes.Internal, "delete volume record error %s", err)
+	}
+	return &csi.DeleteVolumeResponse{}, nil
+}
+
+// ControllerPublishVolume allocates the volume's attach point (if it does
+// not already have one), attaches it to the given node, and persists the
+// device name and ServerInstanceID/ContainerInstanceID through UpdateVolume's
+// existing optimistic-concurrency path. NodePublishVolume reads the
+// persisted device name back rather than allocating its own, so the two
+// sides of the CSI plugin always agree on where the volume attached.
+func (s *ControllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	vol, err := s.resolveVolume(ctx, req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found, error %s", req.GetVolumeId(), err)
+	}
+
+	serverInstanceID := req.GetNodeId()
+
+	devicePath := vol.DeviceName
+	if devicePath == "" {
+		devicePath, err = s.allocateDevice(ctx, serverInstanceID, vol.VolumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "allocate device error %s", err)
+		}
+	}
+
+	if err := s.ebs.AttachVolume(ctx, vol.VolumeID, serverInstanceID, devicePath); err != nil {
+		glog.Errorln("attach ebs volume error", err, "volume", vol.VolumeID, "node", serverInstanceID)
+		return nil, status.Errorf(codes.Internal, "attach ebs volume error %s", err)
+	}
+
+	newVol := *vol
+	newVol.ServerInstanceID = serverInstanceID
+	newVol.ContainerInstanceID = serverInstanceID
+	newVol.DeviceName = devicePath
+	if err := s.dbIns.UpdateVolume(ctx, vol, &newVol); err != nil {
+		return nil, status.Errorf(codes.Internal, "update volume record error %s", err)
+	}
+
+	return &csi.ControllerPublishVolumeResponse{}, nil
+}
+
+// allocateDevice claims the first unused device name in
+// deviceNameCandidates for volumeName on serverInstanceID through
+// MemDB.CreateDevice, keyed by node so two nodes hand out device letters
+// independently of each other.
+func (s *ControllerServer) allocateDevice(ctx context.Context, serverInstanceID string, volumeName string) (string, error) {
+	for _, name := range deviceNameCandidates {
+		dev := &common.Device{
+			ClusterName: serverInstanceID,
+			DeviceName:  name,
+			ServiceName: volumeName,
+		}
+		err := s.dbIns.CreateDevice(ctx, dev)
+		if err == nil {
+			return name, nil
+		}
+		if err != db.ErrDBConditionalCheckFailed {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("no free device name on node %s", serverInstanceID)
+}
+
+// ControllerUnpublishVolume detaches the volume, releases its device name,
+// and clears ServerInstanceID/ContainerInstanceID/DeviceName.
+func (s *ControllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	vol, err := s.resolveVolume(ctx, req.GetVolumeId())
+	if err == db.ErrDBRecordNotFound {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "resolve volume error %s", err)
+	}
+
+	if err := s.ebs.DetachVolume(ctx, vol.VolumeID, vol.ServerInstanceID, vol.DeviceName); err != nil {
+		glog.Errorln("detach ebs volume error", err, "volume", vol.VolumeID)
+		return nil, status.Errorf(codes.Internal, "detach ebs volume error %s", err)
+	}
+
+	if vol.DeviceName != "" {
+		if err := s.dbIns.DeleteDevice(ctx, vol.ServerInstanceID, vol.DeviceName); err != nil && err != db.ErrDBRecordNotFound {
+			return nil, status.Errorf(codes.Internal, "release device error %s", err)
+		}
+	}
+
+	newVol := *vol
+	newVol.ServerInstanceID = ""
+	newVol.ContainerInstanceID = ""
+	newVol.DeviceName = ""
+	if err := s.dbIns.UpdateVolume(ctx, vol, &newVol); err != nil {
+		return nil, status.Errorf(codes.Internal, "update volume record error %s", err)
+	}
+
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities reports firecamp's EBS-backed volumes support
+// single-node read/write mount, which is all firecamp services need.
+func (s *ControllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if _, err := s.resolveVolume(ctx, req.GetVolumeId()); err != nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found, error %s", req.GetVolumeId(), err)
+	}
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{VolumeCapabilities: req.GetVolumeCapabilities()},
+	}, nil
+}
+
+// resolveVolume resolves a CSI volume_id to the underlying common.Volume.
+// If the id carries a zone, GetVolume is used directly; otherwise
+// GetVolumeByID scans across zones by name, per the UNSPECIFIED sentinel
+// convention documented on volumeID.
+func (s *ControllerServer) resolveVolume(ctx context.Context, id string) (*common.Volume, error) {
+	vid, err := parseVolumeID(id)
+	if err != nil {
+		return nil, err
+	}
+	if vid.isZoneSpecified() {
+		return s.dbIns.GetVolume(ctx, vid.ProjectID, vid.Name)
+	}
+	return s.dbIns.GetVolumeByID(ctx, vid.Name)
+}
+
+// pickZone picks the first requisite topology's zone, or "" if the caller
+// left accessibility unspecified.
+func pickZone(top *csi.TopologyRequirement) string {
+	if top == nil || len(top.GetRequisite()) == 0 {
+		return ""
+	}
+	return top.GetRequisite()[0].GetSegments()[zoneTopologyKey]
+}
+
+// zoneTopologyKey is the topology segment key firecamp uses for the AZ,
+// matching the GCE PD CSI driver's convention.
+const zoneTopologyKey = "topology.firecamp.csi/zone"
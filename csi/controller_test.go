@@ -0,0 +1,109 @@
+package csi
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+
+	"github.com/cloudstax/openmanage/common"
+	"github.com/cloudstax/openmanage/db"
+)
+
+// fakeEBS is an in-memory EBS that only records which device each volume
+// is attached at, enough to exercise ControllerServer's device allocation
+// and persistence without talking to real AWS.
+type fakeEBS struct {
+	attached map[string]string
+}
+
+func newFakeEBS() *fakeEBS {
+	return &fakeEBS{attached: make(map[string]string)}
+}
+
+func (f *fakeEBS) CreateVolume(ctx context.Context, az string, sizeGB int64) (string, error) {
+	return "", nil
+}
+func (f *fakeEBS) DeleteVolume(ctx context.Context, ebsVolumeID string) error { return nil }
+
+func (f *fakeEBS) AttachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error {
+	f.attached[ebsVolumeID] = device
+	return nil
+}
+
+func (f *fakeEBS) DetachVolume(ctx context.Context, ebsVolumeID string, serverInstanceID string, device string) error {
+	delete(f.attached, ebsVolumeID)
+	return nil
+}
+
+const testClusterName = "cluster1"
+
+// TestControllerPublishVolumeAllocatesDeviceOnce checks that
+// ControllerPublishVolume allocates a device name exactly once, persists it
+// on the Volume record, and that a NodePublishVolume-style read back
+// (GetVolumeByID) sees that same device name - the invariant the Controller
+// and Node services must agree on.
+func TestControllerPublishVolumeAllocatesDeviceOnce(t *testing.T) {
+	dbIns := db.NewMemDB()
+	ebs := newFakeEBS()
+	s := NewControllerServer(testClusterName, dbIns, ebs)
+
+	volName := "vol1"
+	if err := dbIns.CreateVolume(context.Background(), &common.Volume{
+		ServiceUUID:   testClusterName,
+		VolumeID:      volName,
+		AvailableZone: "us-west-2a",
+	}); err != nil {
+		t.Fatalf("CreateVolume error %s", err)
+	}
+
+	id := newVolumeID(testClusterName, "us-west-2a", volName).String()
+	nodeID := "node1"
+
+	publishReq := &csi.ControllerPublishVolumeRequest{VolumeId: id, NodeId: nodeID}
+	if _, err := s.ControllerPublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatalf("ControllerPublishVolume error %s", err)
+	}
+
+	vol, err := dbIns.GetVolumeByID(context.Background(), volName)
+	if err != nil {
+		t.Fatalf("GetVolumeByID error %s", err)
+	}
+	if vol.DeviceName == "" {
+		t.Fatalf("expected DeviceName to be set after ControllerPublishVolume")
+	}
+	if vol.ServerInstanceID != nodeID {
+		t.Errorf("expected ServerInstanceID %s, got %s", nodeID, vol.ServerInstanceID)
+	}
+	if got := ebs.attached[volName]; got != vol.DeviceName {
+		t.Errorf("expected ebs attached device %s, got %s", vol.DeviceName, got)
+	}
+
+	firstDevice := vol.DeviceName
+
+	// A retry of ControllerPublishVolume (e.g. after a kubelet timeout) must
+	// reuse the already-persisted device name rather than allocating a new
+	// one, or repeated retries would exhaust deviceNameCandidates.
+	if _, err := s.ControllerPublishVolume(context.Background(), publishReq); err != nil {
+		t.Fatalf("retried ControllerPublishVolume error %s", err)
+	}
+	vol, err = dbIns.GetVolumeByID(context.Background(), volName)
+	if err != nil {
+		t.Fatalf("GetVolumeByID error %s", err)
+	}
+	if vol.DeviceName != firstDevice {
+		t.Errorf("expected retry to reuse device %s, got %s", firstDevice, vol.DeviceName)
+	}
+
+	unpublishReq := &csi.ControllerUnpublishVolumeRequest{VolumeId: id}
+	if _, err := s.ControllerUnpublishVolume(context.Background(), unpublishReq); err != nil {
+		t.Fatalf("ControllerUnpublishVolume error %s", err)
+	}
+	vol, err = dbIns.GetVolumeByID(context.Background(), volName)
+	if err != nil {
+		t.Fatalf("GetVolumeByID error %s", err)
+	}
+	if vol.DeviceName != "" {
+		t.Errorf("expected DeviceName cleared after ControllerUnpublishVolume, got %s", vol.DeviceName)
+	}
+}
@@ -0,0 +1,51 @@
+package csi
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// IdentityServer implements the CSI Identity service on top of a firecamp
+// driver instance, so orchestrators can query the plugin's name, version
+// and capabilities before calling into Controller/Node.
+type IdentityServer struct {
+	driverName    string
+	driverVersion string
+}
+
+// NewIdentityServer creates the CSI Identity service.
+func NewIdentityServer(driverName string, driverVersion string) *IdentityServer {
+	return &IdentityServer{driverName: driverName, driverVersion: driverVersion}
+}
+
+// GetPluginInfo returns the driver's name and version.
+func (s *IdentityServer) GetPluginInfo(ctx context.Context, req *csi.GetPluginInfoRequest) (*csi.GetPluginInfoResponse, error) {
+	glog.Infoln("GetPluginInfo", req)
+	return &csi.GetPluginInfoResponse{
+		Name:          s.driverName,
+		VendorVersion: s.driverVersion,
+	}, nil
+}
+
+// GetPluginCapabilities reports that this plugin implements the Controller
+// service, since firecamp volumes are centrally managed through the DB.
+func (s *IdentityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
+	return &csi.GetPluginCapabilitiesResponse{
+		Capabilities: []*csi.PluginCapability{
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_CONTROLLER_SERVICE,
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// Probe reports the plugin is ready; firecamp's DB connection is
+// established at startup, before the grpc server begins serving.
+func (s *IdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	return &csi.ProbeResponse{}, nil
+}
@@ -0,0 +1,122 @@
+package csi
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/cloudstax/openmanage/db"
+)
+
+// defaultFSType is used to format and mount a volume when the CSI request
+// does not specify one.
+const defaultFSType = "ext4"
+
+// NodeServer implements the CSI Node service. The device name (attach
+// point) a volume mounts at is allocated once, by the Controller service in
+// ControllerPublishVolume, and persisted on the Volume record; NodePublishVolume
+// only ever reads it back, so it never hands out a second device name for a
+// volume that is already attached.
+type NodeServer struct {
+	clusterName string
+	nodeID      string
+	dbIns       db.DB
+}
+
+// NewNodeServer creates the CSI Node service for the local node.
+func NewNodeServer(clusterName string, nodeID string, dbIns db.DB) *NodeServer {
+	return &NodeServer{clusterName: clusterName, nodeID: nodeID, dbIns: dbIns}
+}
+
+// NodeGetInfo reports this node's ID, used by the Controller service as the
+// publish target.
+func (s *NodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{NodeId: s.nodeID}, nil
+}
+
+// NodeGetCapabilities reports this Node service's capabilities. firecamp
+// does not need NodeStageVolume, as the device is already attached and
+// ready to mount by the time NodePublishVolume runs.
+func (s *NodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodePublishVolume reads back the device name ControllerPublishVolume
+// allocated and persisted on the Volume record, then formats (if needed)
+// and mounts the now-attached EBS block device at the target path.
+func (s *NodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	vid, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid volume_id %s", err)
+	}
+
+	vol, err := s.dbIns.GetVolumeByID(ctx, vid.Name)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "get volume %s error %s", vid.Name, err)
+	}
+	if vol.DeviceName == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s has no device attached, ControllerPublishVolume must run first", vid.Name)
+	}
+	devicePath := vol.DeviceName
+
+	targetPath := req.GetTargetPath()
+	if err := os.MkdirAll(targetPath, 0755); err != nil {
+		return nil, status.Errorf(codes.Internal, "mkdir %s error %s", targetPath, err)
+	}
+
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if fsType == "" {
+		fsType = defaultFSType
+	}
+	if err := mountDevice(devicePath, targetPath, fsType); err != nil {
+		return nil, status.Errorf(codes.Internal, "mount %s at %s error %s", devicePath, targetPath, err)
+	}
+
+	glog.Infoln("published volume", vid.Name, "device", devicePath, "at", targetPath)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts the target path. The device name allocated
+// for the volume is released by ControllerUnpublishVolume, the same place
+// that owns allocating it, so this has nothing left to clean up in the DB.
+func (s *NodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	if err := unmountDevice(targetPath); err != nil {
+		return nil, status.Errorf(codes.Internal, "unmount %s error %s", targetPath, err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// NodeGetVolumeStats is not yet implemented.
+func (s *NodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "NodeGetVolumeStats not implemented")
+}
+
+// mountDevice formats devicePath if it has no filesystem yet, then mounts
+// it at targetPath.
+func mountDevice(devicePath string, targetPath string, fsType string) error {
+	if err := exec.Command("blkid", devicePath).Run(); err != nil {
+		if out, err := exec.Command("mkfs."+fsType, devicePath).CombinedOutput(); err != nil {
+			return fmt.Errorf("mkfs.%s %s error %s, output %s", fsType, devicePath, err, out)
+		}
+	}
+
+	if out, err := exec.Command("mount", "-t", fsType, devicePath, targetPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("mount %s at %s error %s, output %s", devicePath, targetPath, err, out)
+	}
+	return nil
+}
+
+// unmountDevice unmounts targetPath.
+func unmountDevice(targetPath string) error {
+	if out, err := exec.Command("umount", targetPath).CombinedOutput(); err != nil {
+		return fmt.Errorf("umount %s error %s, output %s", targetPath, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package csi
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unspecified is the sentinel used for a volume ID field the caller does
+// not know, following the GCE PD CSI driver's convention. A controller
+// that only has the volume name may pass UNSPECIFIED for projectID and
+// zone and resolve the rest with a DB scan.
+const unspecified = "UNSPECIFIED"
+
+const volumeIDSeparator = "/"
+
+// volumeID is the decoded form of a CSI volume_id: projectID/zone/name.
+type volumeID struct {
+	ProjectID string
+	Zone      string
+	Name      string
+}
+
+// String encodes the volume ID as projectID/zone/name.
+func (v volumeID) String() string {
+	return v.ProjectID + volumeIDSeparator + v.Zone + volumeIDSeparator + v.Name
+}
+
+// newVolumeID builds a fully-specified volume ID for a newly created volume.
+func newVolumeID(projectID string, zone string, name string) volumeID {
+	return volumeID{ProjectID: projectID, Zone: zone, Name: name}
+}
+
+// parseVolumeID decodes a CSI volume_id of the form projectID/zone/name. A
+// caller that only knows the volume name may pass just "name" or
+// "UNSPECIFIED/UNSPECIFIED/name"; both decode to a volumeID with ProjectID
+// and Zone set to unspecified, signaling the caller must resolve the
+// volume with a DB scan rather than a direct lookup.
+func parseVolumeID(id string) (volumeID, error) {
+	parts := strings.Split(id, volumeIDSeparator)
+	switch len(parts) {
+	case 1:
+		return volumeID{ProjectID: unspecified, Zone: unspecified, Name: parts[0]}, nil
+	case 3:
+		return volumeID{ProjectID: parts[0], Zone: parts[1], Name: parts[2]}, nil
+	default:
+		return volumeID{}, fmt.Errorf("invalid volume_id %q, expect name or projectID/zone/name", id)
+	}
+}
+
+func (v volumeID) isZoneSpecified() bool {
+	return v.ProjectID != unspecified && v.Zone != unspecified
+}
@@ -0,0 +1,82 @@
+package db
+
+import (
+	"errors"
+	"reflect"
+
+	"golang.org/x/net/context"
+
+	"github.com/cloudstax/openmanage/common"
+)
+
+// Errors returned by a DB implementation.
+var (
+	// ErrDBRecordNotFound is returned when the requested record does not exist.
+	ErrDBRecordNotFound = errors.New("db: record not found")
+	// ErrDBConditionalCheckFailed is returned when a create collides with an
+	// existing record, or an update's expected old record does not match
+	// what is currently stored.
+	ErrDBConditionalCheckFailed = errors.New("db: conditional check failed")
+)
+
+// System table status values, returned by SystemTablesReady.
+const (
+	TableStatusCreating = "CREATING"
+	TableStatusActive   = "ACTIVE"
+)
+
+// DB is the storage abstraction every firecamp control-plane component
+// talks to. MemDB is the in-memory implementation: NewMemDB for tests, and
+// NewPersistMemDB, which keeps its data across restarts, for use outside
+// tests; other implementations (e.g. a DynamoDB-backed one) satisfy the
+// same interface for production use.
+type DB interface {
+	CreateSystemTables(ctx context.Context) error
+	SystemTablesReady(ctx context.Context) (tableStatus string, ready bool, err error)
+	DeleteSystemTables(ctx context.Context) error
+
+	CreateDevice(ctx context.Context, dev *common.Device) error
+	GetDevice(ctx context.Context, clusterName string, deviceName string) (dev *common.Device, err error)
+	DeleteDevice(ctx context.Context, clusterName string, deviceName string) error
+	ListDevices(ctx context.Context, clusterName string) (devs []*common.Device, err error)
+
+	CreateService(ctx context.Context, svc *common.Service) error
+	GetService(ctx context.Context, clusterName string, serviceName string) (svc *common.Service, err error)
+	DeleteService(ctx context.Context, clusterName string, serviceName string) error
+	ListServices(ctx context.Context, clusterName string) (svcs []*common.Service, err error)
+
+	CreateServiceAttr(ctx context.Context, attr *common.ServiceAttr) error
+	UpdateServiceAttr(ctx context.Context, oldAttr *common.ServiceAttr, newAttr *common.ServiceAttr) error
+	GetServiceAttr(ctx context.Context, serviceUUID string) (attr *common.ServiceAttr, err error)
+	DeleteServiceAttr(ctx context.Context, serviceUUID string) error
+
+	CreateServiceEndpoints(ctx context.Context, eps *ServiceEndpoints) error
+	UpdateServiceEndpoints(ctx context.Context, serviceUUID string, eps *ServiceEndpoints) error
+	GetServiceEndpoints(ctx context.Context, serviceUUID string) (eps *ServiceEndpoints, err error)
+	DeleteServiceEndpoints(ctx context.Context, serviceUUID string) error
+
+	CreateVolume(ctx context.Context, vol *common.Volume) error
+	UpdateVolume(ctx context.Context, oldVol *common.Volume, newVol *common.Volume) error
+	GetVolume(ctx context.Context, serviceUUID string, volumeID string) (vol *common.Volume, err error)
+	GetVolumeByID(ctx context.Context, volumeID string) (vol *common.Volume, err error)
+	ListVolumes(ctx context.Context, serviceUUID string) (vols []*common.Volume, err error)
+	DeleteVolume(ctx context.Context, serviceUUID string, volumeID string) error
+
+	CreateConfigFile(ctx context.Context, cfg *common.ConfigFile) error
+	GetConfigFile(ctx context.Context, serviceUUID string, fileID string) (cfg *common.ConfigFile, err error)
+	DeleteConfigFile(ctx context.Context, serviceUUID string, fileID string) error
+}
+
+// EqualVolume compares two volumes for the optimistic-concurrency check in
+// UpdateVolume. skipMtime allows the caller to ignore LastModified, as the
+// caller usually only has a slightly stale copy of it.
+func EqualVolume(t1 *common.Volume, t2 *common.Volume, skipMtime bool) bool {
+	if skipMtime {
+		c1 := *t1
+		c2 := *t2
+		c1.LastModified = 0
+		c2.LastModified = 0
+		return reflect.DeepEqual(c1, c2)
+	}
+	return reflect.DeepEqual(*t1, *t2)
+}
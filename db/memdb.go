@@ -1,6 +1,7 @@
 package db
 
 import (
+	"hash/fnv"
 	"sync"
 
 	"github.com/golang/glog"
@@ -9,27 +10,89 @@ import (
 	"github.com/cloudstax/openmanage/common"
 )
 
-type MemDB struct {
+// Endpoint is one service member's dns record inputs: the member's current
+// IP, availability zone, region, and whether it is currently healthy. The
+// dns reconciler uses this to compute the per-member, per-AZ, per-region
+// and global aggregate rrsets for a service.
+type Endpoint struct {
+	MemberName    string
+	IP            string
+	AvailableZone string
+	Region        string
+	Healthy       bool
+}
+
+// ServiceEndpoints is the persisted endpoint set for one service, keyed by
+// ServiceUUID, so the dns reconciler can resume from the last known health
+// state after a crash instead of waiting to rediscover it.
+type ServiceEndpoints struct {
+	ServiceUUID string
+	// Endpoints is keyed by MemberName.
+	Endpoints map[string]Endpoint
+}
+
+// numShards is the number of shards MemDB splits its maps across. Reads
+// (ListServices, GetVolume, ...) dominate writes in a running cluster, and
+// most calls are already scoped to a single cluster/service, so sharding on
+// that key and using a RWMutex per shard lets unrelated clusters/services
+// proceed without contending on one global lock.
+const numShards = 32
+
+// shard holds one slice of every map MemDB manages, each guarded by its own
+// RWMutex.
+type shard struct {
+	lock       sync.RWMutex
 	devMap     map[string]common.Device
 	svcMap     map[string]common.Service
 	svcAttrMap map[string]common.ServiceAttr
 	volMap     map[string]common.Volume
 	cfgMap     map[string]common.ConfigFile
-	mlock      *sync.Mutex
+	epMap      map[string]ServiceEndpoints
 }
 
-func NewMemDB() *MemDB {
-	d := &MemDB{
+func newShard() *shard {
+	return &shard{
 		devMap:     map[string]common.Device{},
 		svcMap:     map[string]common.Service{},
 		svcAttrMap: map[string]common.ServiceAttr{},
 		volMap:     map[string]common.Volume{},
 		cfgMap:     map[string]common.ConfigFile{},
-		mlock:      &sync.Mutex{},
+		epMap:      map[string]ServiceEndpoints{},
+	}
+}
+
+// MemDB is a DB implementation backed by in-memory maps. NewMemDB returns a
+// MemDB that keeps no record of its data beyond the process lifetime,
+// suitable for unit tests. NewPersistMemDB additionally logs every mutation
+// to a WAL and periodically snapshots, so the data survives a restart -
+// see persist.go.
+type MemDB struct {
+	shards [numShards]*shard
+
+	persist *persister
+}
+
+func NewMemDB() *MemDB {
+	d := &MemDB{}
+	for i := range d.shards {
+		d.shards[i] = newShard()
 	}
 	return d
 }
 
+// shardIndex hashes key (a ClusterName or ServiceUUID - whichever groups a
+// map's entries together, mirroring the existing ClusterName+ServiceName
+// key composition) to a shard index.
+func shardIndex(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32() % numShards
+}
+
+func (d *MemDB) shardFor(key string) *shard {
+	return d.shards[shardIndex(key)]
+}
+
 func (d *MemDB) CreateSystemTables(ctx context.Context) error {
 	return nil
 }
@@ -44,27 +107,29 @@ func (d *MemDB) DeleteSystemTables(ctx context.Context) error {
 
 func (d *MemDB) CreateDevice(ctx context.Context, dev *common.Device) error {
 	key := dev.ClusterName + dev.DeviceName
+	s := d.shardFor(dev.ClusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.devMap[key]
+	s.lock.Lock()
+	_, ok := s.devMap[key]
 	if ok {
+		s.lock.Unlock()
 		glog.Errorln("device exists", key)
 		return ErrDBConditionalCheckFailed
 	}
+	s.devMap[key] = *dev
+	s.lock.Unlock()
 
-	d.devMap[key] = *dev
-	return nil
+	return d.persist.logCreateDevice(dev)
 }
 
 func (d *MemDB) GetDevice(ctx context.Context, clusterName string, deviceName string) (dev *common.Device, err error) {
 	key := clusterName + deviceName
+	s := d.shardFor(clusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	cdev, ok := d.devMap[key]
+	cdev, ok := s.devMap[key]
 	if !ok {
 		glog.Errorln("device not found", key)
 		return nil, ErrDBRecordNotFound
@@ -74,18 +139,19 @@ func (d *MemDB) GetDevice(ctx context.Context, clusterName string, deviceName st
 
 func (d *MemDB) DeleteDevice(ctx context.Context, clusterName string, deviceName string) error {
 	key := clusterName + deviceName
+	s := d.shardFor(clusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.devMap[key]
+	s.lock.Lock()
+	_, ok := s.devMap[key]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("device not exist", key)
 		return ErrDBRecordNotFound
 	}
+	delete(s.devMap, key)
+	s.lock.Unlock()
 
-	delete(d.devMap, key)
-	return nil
+	return d.persist.logDeleteDevice(clusterName, deviceName)
 }
 
 func (d *MemDB) ListDevices(ctx context.Context, clusterName string) (devs []*common.Device, err error) {
@@ -93,41 +159,44 @@ func (d *MemDB) ListDevices(ctx context.Context, clusterName string) (devs []*co
 }
 
 func (d *MemDB) listDevicesWithLimit(ctx context.Context, clusterName string, limit int64) (devs []*common.Device, err error) {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(clusterName)
 
-	devs = make([]*common.Device, len(d.devMap))
-	idx := 0
-	for _, dev := range d.devMap {
-		devs[idx] = copyDevice(&dev)
-		idx++
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, dev := range s.devMap {
+		if dev.ClusterName == clusterName {
+			devs = append(devs, copyDevice(&dev))
+		}
 	}
 	return devs, nil
 }
 
 func (d *MemDB) CreateService(ctx context.Context, svc *common.Service) error {
 	key := svc.ClusterName + svc.ServiceName
+	s := d.shardFor(svc.ClusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.svcMap[key]
+	s.lock.Lock()
+	_, ok := s.svcMap[key]
 	if ok {
+		s.lock.Unlock()
 		glog.Errorln("service exists", key)
 		return ErrDBConditionalCheckFailed
 	}
+	s.svcMap[key] = *svc
+	s.lock.Unlock()
 
-	d.svcMap[key] = *svc
-	return nil
+	return d.persist.logCreateService(svc)
 }
 
 func (d *MemDB) GetService(ctx context.Context, clusterName string, serviceName string) (svc *common.Service, err error) {
 	key := clusterName + serviceName
+	s := d.shardFor(clusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	csvc, ok := d.svcMap[key]
+	csvc, ok := s.svcMap[key]
 	if !ok {
 		glog.Errorln("service not exist", key)
 		return nil, ErrDBRecordNotFound
@@ -137,18 +206,19 @@ func (d *MemDB) GetService(ctx context.Context, clusterName string, serviceName
 
 func (d *MemDB) DeleteService(ctx context.Context, clusterName string, serviceName string) error {
 	key := clusterName + serviceName
+	s := d.shardFor(clusterName)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.svcMap[key]
+	s.lock.Lock()
+	_, ok := s.svcMap[key]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("service not exist", key)
 		return ErrDBRecordNotFound
 	}
+	delete(s.svcMap, key)
+	s.lock.Unlock()
 
-	delete(d.svcMap, key)
-	return nil
+	return d.persist.logDeleteService(clusterName, serviceName)
 }
 
 func (d *MemDB) ListServices(ctx context.Context, clusterName string) (svcs []*common.Service, err error) {
@@ -156,51 +226,58 @@ func (d *MemDB) ListServices(ctx context.Context, clusterName string) (svcs []*c
 }
 
 func (d *MemDB) listServicesWithLimit(ctx context.Context, clusterName string, limit int64) (svcs []*common.Service, err error) {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(clusterName)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	svcs = make([]*common.Service, len(d.svcMap))
-	idx := 0
-	for _, svc := range d.svcMap {
-		svcs[idx] = copyService(&svc)
-		idx++
+	for _, svc := range s.svcMap {
+		if svc.ClusterName == clusterName {
+			svcs = append(svcs, copyService(&svc))
+		}
 	}
 	return svcs, nil
 }
 
 func (d *MemDB) CreateServiceAttr(ctx context.Context, attr *common.ServiceAttr) error {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(attr.ServiceUUID)
 
-	_, ok := d.svcAttrMap[attr.ServiceUUID]
+	s.lock.Lock()
+	_, ok := s.svcAttrMap[attr.ServiceUUID]
 	if ok {
+		s.lock.Unlock()
 		glog.Errorln("ServiceAttr exists", attr)
 		return ErrDBConditionalCheckFailed
 	}
+	s.svcAttrMap[attr.ServiceUUID] = *attr
+	s.lock.Unlock()
 
-	d.svcAttrMap[attr.ServiceUUID] = *attr
-	return nil
+	return d.persist.logCreateServiceAttr(attr)
 }
 
 func (d *MemDB) UpdateServiceAttr(ctx context.Context, oldAttr *common.ServiceAttr, newAttr *common.ServiceAttr) error {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(oldAttr.ServiceUUID)
 
-	_, ok := d.svcAttrMap[oldAttr.ServiceUUID]
+	s.lock.Lock()
+	_, ok := s.svcAttrMap[oldAttr.ServiceUUID]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("serviceAttr not exist", oldAttr)
 		return ErrDBRecordNotFound
 	}
+	s.svcAttrMap[oldAttr.ServiceUUID] = *newAttr
+	s.lock.Unlock()
 
-	d.svcAttrMap[oldAttr.ServiceUUID] = *newAttr
-	return nil
+	return d.persist.logUpdateServiceAttr(newAttr)
 }
 
 func (d *MemDB) GetServiceAttr(ctx context.Context, serviceUUID string) (attr *common.ServiceAttr, err error) {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(serviceUUID)
 
-	cattr, ok := d.svcAttrMap[serviceUUID]
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	cattr, ok := s.svcAttrMap[serviceUUID]
 	if !ok {
 		glog.Errorln("ServiceAttr not exists", serviceUUID)
 		return nil, ErrDBRecordNotFound
@@ -210,62 +287,132 @@ func (d *MemDB) GetServiceAttr(ctx context.Context, serviceUUID string) (attr *c
 }
 
 func (d *MemDB) DeleteServiceAttr(ctx context.Context, serviceUUID string) error {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(serviceUUID)
 
-	_, ok := d.svcAttrMap[serviceUUID]
+	s.lock.Lock()
+	_, ok := s.svcAttrMap[serviceUUID]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("ServiceAttr not exists", serviceUUID)
 		return ErrDBRecordNotFound
 	}
+	delete(s.svcAttrMap, serviceUUID)
+	s.lock.Unlock()
 
-	delete(d.svcAttrMap, serviceUUID)
-	return nil
+	return d.persist.logDeleteServiceAttr(serviceUUID)
+}
+
+func (d *MemDB) CreateServiceEndpoints(ctx context.Context, eps *ServiceEndpoints) error {
+	s := d.shardFor(eps.ServiceUUID)
+
+	s.lock.Lock()
+	_, ok := s.epMap[eps.ServiceUUID]
+	if ok {
+		s.lock.Unlock()
+		glog.Errorln("ServiceEndpoints exists", eps.ServiceUUID)
+		return ErrDBConditionalCheckFailed
+	}
+	s.epMap[eps.ServiceUUID] = copyServiceEndpoints(eps)
+	s.lock.Unlock()
+
+	return d.persist.logCreateServiceEndpoints(eps)
+}
+
+func (d *MemDB) UpdateServiceEndpoints(ctx context.Context, serviceUUID string, eps *ServiceEndpoints) error {
+	s := d.shardFor(serviceUUID)
+
+	s.lock.Lock()
+	_, ok := s.epMap[serviceUUID]
+	if !ok {
+		s.lock.Unlock()
+		glog.Errorln("ServiceEndpoints not exist", serviceUUID)
+		return ErrDBRecordNotFound
+	}
+	s.epMap[serviceUUID] = copyServiceEndpoints(eps)
+	s.lock.Unlock()
+
+	return d.persist.logUpdateServiceEndpoints(eps)
+}
+
+func (d *MemDB) GetServiceEndpoints(ctx context.Context, serviceUUID string) (eps *ServiceEndpoints, err error) {
+	s := d.shardFor(serviceUUID)
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	ceps, ok := s.epMap[serviceUUID]
+	if !ok {
+		glog.Errorln("ServiceEndpoints not exist", serviceUUID)
+		return nil, ErrDBRecordNotFound
+	}
+
+	cp := copyServiceEndpoints(&ceps)
+	return &cp, nil
+}
+
+func (d *MemDB) DeleteServiceEndpoints(ctx context.Context, serviceUUID string) error {
+	s := d.shardFor(serviceUUID)
+
+	s.lock.Lock()
+	_, ok := s.epMap[serviceUUID]
+	if !ok {
+		s.lock.Unlock()
+		glog.Errorln("ServiceEndpoints not exist", serviceUUID)
+		return ErrDBRecordNotFound
+	}
+	delete(s.epMap, serviceUUID)
+	s.lock.Unlock()
+
+	return d.persist.logDeleteServiceEndpoints(serviceUUID)
 }
 
 func (d *MemDB) CreateVolume(ctx context.Context, vol *common.Volume) error {
 	key := vol.ServiceUUID + vol.VolumeID
+	s := d.shardFor(vol.ServiceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.volMap[key]
+	s.lock.Lock()
+	_, ok := s.volMap[key]
 	if ok {
+		s.lock.Unlock()
 		glog.Errorln("volume exists", key)
 		return ErrDBConditionalCheckFailed
 	}
+	s.volMap[key] = *vol
+	s.lock.Unlock()
 
-	d.volMap[key] = *vol
-	return nil
+	return d.persist.logCreateVolume(vol)
 }
 
 func (d *MemDB) UpdateVolume(ctx context.Context, oldVol *common.Volume, newVol *common.Volume) error {
 	key := oldVol.ServiceUUID + oldVol.VolumeID
+	s := d.shardFor(oldVol.ServiceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	vol, ok := d.volMap[key]
+	s.lock.Lock()
+	vol, ok := s.volMap[key]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("volume not exist", key)
 		return ErrDBRecordNotFound
 	}
 	if !EqualVolume(oldVol, &vol, true) {
+		s.lock.Unlock()
 		glog.Errorln("oldVol not match current vol, oldVol", oldVol, "current vol", vol)
 		return ErrDBConditionalCheckFailed
 	}
+	s.volMap[key] = *newVol
+	s.lock.Unlock()
 
-	d.volMap[key] = *newVol
-	return nil
+	return d.persist.logUpdateVolume(newVol)
 }
 
 func (d *MemDB) GetVolume(ctx context.Context, serviceUUID string, volumeID string) (vol *common.Volume, err error) {
 	key := serviceUUID + volumeID
+	s := d.shardFor(serviceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	cvol, ok := d.volMap[key]
+	cvol, ok := s.volMap[key]
 	if !ok {
 		glog.Errorln("volume not exist", key)
 		return nil, ErrDBRecordNotFound
@@ -274,15 +421,38 @@ func (d *MemDB) GetVolume(ctx context.Context, serviceUUID string, volumeID stri
 	return copyVolume(&cvol), nil
 }
 
+// GetVolumeByID looks up a volume by its VolumeID alone, scanning every
+// shard's volumes. This is slower than GetVolume, which goes straight to
+// the shard owning ServiceUUID, so callers that already know the
+// ServiceUUID should prefer GetVolume; it exists for callers such as the
+// CSI plugin that only have the volume name to go on.
+func (d *MemDB) GetVolumeByID(ctx context.Context, volumeID string) (vol *common.Volume, err error) {
+	for _, s := range d.shards {
+		s.lock.RLock()
+		for _, v := range s.volMap {
+			if v.VolumeID == volumeID {
+				s.lock.RUnlock()
+				return copyVolume(&v), nil
+			}
+		}
+		s.lock.RUnlock()
+	}
+
+	glog.Errorln("volume not exist", volumeID)
+	return nil, ErrDBRecordNotFound
+}
+
 func (d *MemDB) ListVolumes(ctx context.Context, serviceUUID string) (vols []*common.Volume, err error) {
 	return d.listVolumesWithLimit(ctx, serviceUUID, 0)
 }
 
 func (d *MemDB) listVolumesWithLimit(ctx context.Context, serviceUUID string, limit int64) (vols []*common.Volume, err error) {
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s := d.shardFor(serviceUUID)
 
-	for _, vol := range d.volMap {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, vol := range s.volMap {
 		if vol.ServiceUUID == serviceUUID {
 			vols = append(vols, copyVolume(&vol))
 		}
@@ -292,43 +462,46 @@ func (d *MemDB) listVolumesWithLimit(ctx context.Context, serviceUUID string, li
 
 func (d *MemDB) DeleteVolume(ctx context.Context, serviceUUID string, volumeID string) error {
 	key := serviceUUID + volumeID
+	s := d.shardFor(serviceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.volMap[key]
+	s.lock.Lock()
+	_, ok := s.volMap[key]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("volume not exist", key)
 		return ErrDBRecordNotFound
 	}
+	delete(s.volMap, key)
+	s.lock.Unlock()
 
-	delete(d.volMap, key)
-	return nil
+	return d.persist.logDeleteVolume(serviceUUID, volumeID)
 }
 
 func (d *MemDB) CreateConfigFile(ctx context.Context, cfg *common.ConfigFile) error {
 	key := cfg.ServiceUUID + cfg.FileID
+	s := d.shardFor(cfg.ServiceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.cfgMap[key]
+	s.lock.Lock()
+	_, ok := s.cfgMap[key]
 	if ok {
+		s.lock.Unlock()
 		glog.Errorln("config file exists", key)
 		return ErrDBConditionalCheckFailed
 	}
+	s.cfgMap[key] = *cfg
+	s.lock.Unlock()
 
-	d.cfgMap[key] = *cfg
-	return nil
+	return d.persist.logCreateConfigFile(cfg)
 }
 
 func (d *MemDB) GetConfigFile(ctx context.Context, serviceUUID string, fileID string) (cfg *common.ConfigFile, err error) {
 	key := serviceUUID + fileID
+	s := d.shardFor(serviceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
+	s.lock.RLock()
+	defer s.lock.RUnlock()
 
-	c, ok := d.cfgMap[key]
+	c, ok := s.cfgMap[key]
 	if !ok {
 		glog.Errorln("config file not exist", key)
 		return nil, ErrDBRecordNotFound
@@ -339,18 +512,19 @@ func (d *MemDB) GetConfigFile(ctx context.Context, serviceUUID string, fileID st
 
 func (d *MemDB) DeleteConfigFile(ctx context.Context, serviceUUID string, fileID string) error {
 	key := serviceUUID + fileID
+	s := d.shardFor(serviceUUID)
 
-	d.mlock.Lock()
-	defer d.mlock.Unlock()
-
-	_, ok := d.cfgMap[key]
+	s.lock.Lock()
+	_, ok := s.cfgMap[key]
 	if !ok {
+		s.lock.Unlock()
 		glog.Errorln("config file not exist", key)
 		return ErrDBRecordNotFound
 	}
+	delete(s.cfgMap, key)
+	s.lock.Unlock()
 
-	delete(d.cfgMap, key)
-	return nil
+	return d.persist.logDeleteConfigFile(serviceUUID, fileID)
 }
 
 func copyDevice(t *common.Device) *common.Device {
@@ -385,6 +559,17 @@ func copyServiceAttr(t *common.ServiceAttr) *common.ServiceAttr {
 	}
 }
 
+func copyServiceEndpoints(t *ServiceEndpoints) ServiceEndpoints {
+	eps := make(map[string]Endpoint)
+	for k, v := range t.Endpoints {
+		eps[k] = v
+	}
+	return ServiceEndpoints{
+		ServiceUUID: t.ServiceUUID,
+		Endpoints:   eps,
+	}
+}
+
 func copyVolume(t *common.Volume) *common.Volume {
 	return &common.Volume{
 		ServiceUUID:         t.ServiceUUID,
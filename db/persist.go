@@ -0,0 +1,543 @@
+package db
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+
+	"github.com/cloudstax/openmanage/common"
+)
+
+const (
+	walFileName      = "memdb.wal"
+	snapshotFileName = "memdb.snapshot"
+
+	// snapshotInterval bounds how long WAL replay takes after a restart:
+	// replay only ever has to cover the mutations since the last snapshot.
+	snapshotInterval = 5 * time.Minute
+)
+
+// op identifies which mutating MemDB call produced a walRecord.
+type op string
+
+const (
+	opCreateDevice           op = "CreateDevice"
+	opDeleteDevice           op = "DeleteDevice"
+	opCreateService          op = "CreateService"
+	opDeleteService          op = "DeleteService"
+	opCreateServiceAttr      op = "CreateServiceAttr"
+	opUpdateServiceAttr      op = "UpdateServiceAttr"
+	opDeleteServiceAttr      op = "DeleteServiceAttr"
+	opCreateServiceEndpoints op = "CreateServiceEndpoints"
+	opUpdateServiceEndpoints op = "UpdateServiceEndpoints"
+	opDeleteServiceEndpoints op = "DeleteServiceEndpoints"
+	opCreateVolume           op = "CreateVolume"
+	opUpdateVolume           op = "UpdateVolume"
+	opDeleteVolume           op = "DeleteVolume"
+	opCreateConfigFile       op = "CreateConfigFile"
+	opDeleteConfigFile       op = "DeleteConfigFile"
+)
+
+// walRecord is one WAL entry. Only the field(s) matching Op are populated;
+// a delete only needs DeleteKey1/DeleteKey2, the same key parts the
+// corresponding Delete* call took.
+type walRecord struct {
+	Op op
+
+	Device           *common.Device
+	Service          *common.Service
+	ServiceAttr      *common.ServiceAttr
+	ServiceEndpoints *ServiceEndpoints
+	Volume           *common.Volume
+	ConfigFile       *common.ConfigFile
+
+	DeleteKey1 string
+	DeleteKey2 string
+}
+
+// dbSnapshot is the full MemDB state, gob-encoded by (*persister).snapshot
+// and replayed by loadSnapshot.
+type dbSnapshot struct {
+	Devices          []common.Device
+	Services         []common.Service
+	ServiceAttrs     []common.ServiceAttr
+	ServiceEndpoints []ServiceEndpoints
+	Volumes          []common.Volume
+	ConfigFiles      []common.ConfigFile
+}
+
+// persister appends every mutating MemDB call to a WAL file and
+// periodically writes a full snapshot, so a MemDB created with
+// NewPersistMemDB survives a process restart. A MemDB created with the
+// plain NewMemDB constructor has a nil persister; every logX method is
+// nil-receiver safe and does nothing in that case, so the CRUD methods in
+// memdb.go do not need to special-case the in-memory-only mode.
+type persister struct {
+	dataDir string
+	db      *MemDB
+
+	walMu sync.Mutex
+	wal   *os.File
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// NewPersistMemDB creates a MemDB that replays dataDir's latest snapshot
+// and WAL tail on startup, then logs every further mutation to the WAL and
+// periodically snapshots. This is meant for running MemDB outside of
+// tests, e.g. a dev/on-prem deployment that has no other DB service
+// available, where losing all state on every restart is not acceptable.
+func NewPersistMemDB(dataDir string) (*MemDB, error) {
+	d := NewMemDB()
+
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("mkdir %s error %s", dataDir, err)
+	}
+
+	p := &persister{dataDir: dataDir, db: d, stopCh: make(chan struct{}), doneCh: make(chan struct{})}
+
+	if err := p.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := p.replayWAL(); err != nil {
+		return nil, err
+	}
+
+	wal, err := os.OpenFile(p.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open wal %s error %s", p.walPath(), err)
+	}
+	p.wal = wal
+
+	d.persist = p
+
+	go p.snapshotLoop()
+
+	return d, nil
+}
+
+// Close stops the background snapshot loop and closes the WAL file. It is
+// a no-op on a MemDB created with the plain, non-persistent constructor.
+//
+// It waits for snapshotLoop to actually return before touching p.wal:
+// snapshotLoop's rotateWAL closes and reassigns p.wal under walMu, so
+// closing p.wal here without first waiting for that to finish (and then
+// taking walMu) would race it.
+func (d *MemDB) Close() {
+	if d.persist == nil {
+		return
+	}
+	p := d.persist
+	close(p.stopCh)
+	<-p.doneCh
+
+	p.walMu.Lock()
+	defer p.walMu.Unlock()
+	p.wal.Close()
+}
+
+func (p *persister) walPath() string         { return filepath.Join(p.dataDir, walFileName) }
+func (p *persister) walTmpPath() string      { return p.walPath() + ".tmp" }
+func (p *persister) snapshotPath() string    { return filepath.Join(p.dataDir, snapshotFileName) }
+func (p *persister) snapshotTmpPath() string { return p.snapshotPath() + ".tmp" }
+
+func (p *persister) loadSnapshot() error {
+	f, err := os.Open(p.snapshotPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open snapshot %s error %s", p.snapshotPath(), err)
+	}
+	defer f.Close()
+
+	var snap dbSnapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return fmt.Errorf("decode snapshot %s error %s", p.snapshotPath(), err)
+	}
+
+	for _, dev := range snap.Devices {
+		s := p.db.shardFor(dev.ClusterName)
+		s.devMap[dev.ClusterName+dev.DeviceName] = dev
+	}
+	for _, svc := range snap.Services {
+		s := p.db.shardFor(svc.ClusterName)
+		s.svcMap[svc.ClusterName+svc.ServiceName] = svc
+	}
+	for _, attr := range snap.ServiceAttrs {
+		s := p.db.shardFor(attr.ServiceUUID)
+		s.svcAttrMap[attr.ServiceUUID] = attr
+	}
+	for _, eps := range snap.ServiceEndpoints {
+		s := p.db.shardFor(eps.ServiceUUID)
+		s.epMap[eps.ServiceUUID] = copyServiceEndpoints(&eps)
+	}
+	for _, vol := range snap.Volumes {
+		s := p.db.shardFor(vol.ServiceUUID)
+		s.volMap[vol.ServiceUUID+vol.VolumeID] = vol
+	}
+	for _, cfg := range snap.ConfigFiles {
+		s := p.db.shardFor(cfg.ServiceUUID)
+		s.cfgMap[cfg.ServiceUUID+cfg.FileID] = cfg
+	}
+
+	glog.Infoln("loaded snapshot", p.snapshotPath())
+	return nil
+}
+
+// replayWAL reads every length-prefixed walRecord written since the last
+// snapshot and re-applies it, so MemDB's state catches up to exactly where
+// it was before the restart.
+func (p *persister) replayWAL() error {
+	f, err := os.Open(p.walPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open wal %s error %s", p.walPath(), err)
+	}
+	defer f.Close()
+
+	count := 0
+	for {
+		var lenBuf [4]byte
+		if _, err := io.ReadFull(f, lenBuf[:]); err != nil {
+			if err == io.EOF {
+				break
+			}
+			if err == io.ErrUnexpectedEOF {
+				// The crash cut the record inside its length prefix.
+				glog.Warningln("wal record length truncated, stopping replay", err)
+				break
+			}
+			return fmt.Errorf("read wal record length error %s", err)
+		}
+
+		recLen := binary.BigEndian.Uint32(lenBuf[:])
+		recBuf := make([]byte, recLen)
+		if _, err := io.ReadFull(f, recBuf); err != nil {
+			// A partial trailing record means the process crashed mid-write;
+			// stop replay here rather than failing startup over it.
+			glog.Warningln("wal record truncated, stopping replay", err)
+			break
+		}
+
+		var rec walRecord
+		if err := gob.NewDecoder(bytes.NewReader(recBuf)).Decode(&rec); err != nil {
+			glog.Warningln("wal record corrupt, stopping replay", err)
+			break
+		}
+
+		p.db.applyRecord(rec)
+		count++
+	}
+
+	glog.Infoln("replayed", count, "wal records from", p.walPath())
+	return nil
+}
+
+// applyRecord replays a single walRecord directly against the shard maps,
+// bypassing the normal Create/Update/Delete validation (the record was
+// already accepted once, before the restart) and bypassing logging (to
+// avoid re-appending what was just read back from the WAL).
+func (d *MemDB) applyRecord(rec walRecord) {
+	switch rec.Op {
+	case opCreateDevice:
+		dev := rec.Device
+		s := d.shardFor(dev.ClusterName)
+		s.devMap[dev.ClusterName+dev.DeviceName] = *dev
+	case opDeleteDevice:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.devMap, rec.DeleteKey1+rec.DeleteKey2)
+
+	case opCreateService:
+		svc := rec.Service
+		s := d.shardFor(svc.ClusterName)
+		s.svcMap[svc.ClusterName+svc.ServiceName] = *svc
+	case opDeleteService:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.svcMap, rec.DeleteKey1+rec.DeleteKey2)
+
+	case opCreateServiceAttr, opUpdateServiceAttr:
+		attr := rec.ServiceAttr
+		s := d.shardFor(attr.ServiceUUID)
+		s.svcAttrMap[attr.ServiceUUID] = *attr
+	case opDeleteServiceAttr:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.svcAttrMap, rec.DeleteKey1)
+
+	case opCreateServiceEndpoints, opUpdateServiceEndpoints:
+		eps := rec.ServiceEndpoints
+		s := d.shardFor(eps.ServiceUUID)
+		s.epMap[eps.ServiceUUID] = copyServiceEndpoints(eps)
+	case opDeleteServiceEndpoints:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.epMap, rec.DeleteKey1)
+
+	case opCreateVolume, opUpdateVolume:
+		vol := rec.Volume
+		s := d.shardFor(vol.ServiceUUID)
+		s.volMap[vol.ServiceUUID+vol.VolumeID] = *vol
+	case opDeleteVolume:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.volMap, rec.DeleteKey1+rec.DeleteKey2)
+
+	case opCreateConfigFile:
+		cfg := rec.ConfigFile
+		s := d.shardFor(cfg.ServiceUUID)
+		s.cfgMap[cfg.ServiceUUID+cfg.FileID] = *cfg
+	case opDeleteConfigFile:
+		s := d.shardFor(rec.DeleteKey1)
+		delete(s.cfgMap, rec.DeleteKey1+rec.DeleteKey2)
+
+	default:
+		glog.Warningln("unknown wal record op", rec.Op)
+	}
+}
+
+// snapshotLoop periodically writes a full snapshot and rotates the WAL, so
+// WAL replay after a restart is always bounded by snapshotInterval rather
+// than growing without limit over the life of the process.
+func (p *persister) snapshotLoop() {
+	defer close(p.doneCh)
+	ticker := time.NewTicker(snapshotInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.snapshot(); err != nil {
+				glog.Errorln("snapshot error", err)
+			}
+		case <-p.stopCh:
+			return
+		}
+	}
+}
+
+// snapshot writes every shard's maps to snapshotTmpPath, fsyncs, then
+// renames it over snapshotPath, and rotates the WAL so replay never has to
+// walk more than one snapshotInterval worth of records.
+//
+// Each shard is only copied under its own RLock, not under a lock spanning
+// the whole snapshot, so a write to a shard copied earlier in the loop can
+// still land after this snapshot's view of it was taken. Recording the
+// WAL's length before copying any shard and only rotating away the prefix
+// up to that length (rotateWAL) keeps such a write safe: its append always
+// happens after its map mutation, so by the time snapshot started it was
+// either already in the map (and so in the snapshot) or its WAL record is
+// at or after startOffset and survives the rotation either way.
+func (p *persister) snapshot() error {
+	startOffset, err := p.walOffset()
+	if err != nil {
+		return err
+	}
+
+	snap := dbSnapshot{}
+	for _, s := range p.db.shards {
+		s.lock.RLock()
+		for _, dev := range s.devMap {
+			snap.Devices = append(snap.Devices, dev)
+		}
+		for _, svc := range s.svcMap {
+			snap.Services = append(snap.Services, svc)
+		}
+		for _, attr := range s.svcAttrMap {
+			snap.ServiceAttrs = append(snap.ServiceAttrs, attr)
+		}
+		for _, eps := range s.epMap {
+			snap.ServiceEndpoints = append(snap.ServiceEndpoints, copyServiceEndpoints(&eps))
+		}
+		for _, vol := range s.volMap {
+			snap.Volumes = append(snap.Volumes, vol)
+		}
+		for _, cfg := range s.cfgMap {
+			snap.ConfigFiles = append(snap.ConfigFiles, cfg)
+		}
+		s.lock.RUnlock()
+	}
+
+	f, err := os.Create(p.snapshotTmpPath())
+	if err != nil {
+		return fmt.Errorf("create snapshot tmp file error %s", err)
+	}
+	if err := gob.NewEncoder(f).Encode(&snap); err != nil {
+		f.Close()
+		return fmt.Errorf("encode snapshot error %s", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("fsync snapshot error %s", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("close snapshot error %s", err)
+	}
+	if err := os.Rename(p.snapshotTmpPath(), p.snapshotPath()); err != nil {
+		return fmt.Errorf("rename snapshot error %s", err)
+	}
+
+	return p.rotateWAL(startOffset)
+}
+
+// walOffset returns the WAL's current length, i.e. the point a record
+// appended right now would start at.
+func (p *persister) walOffset() (int64, error) {
+	p.walMu.Lock()
+	defer p.walMu.Unlock()
+
+	fi, err := p.wal.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("stat wal %s error %s", p.walPath(), err)
+	}
+	return fi.Size(), nil
+}
+
+// rotateWAL compacts the WAL down to only the records at or after
+// startOffset, rather than truncating it to empty: a record already
+// counted in the snapshot this call follows is always before startOffset
+// (see snapshot's comment), so dropping everything before it is safe, but
+// a record appended during the snapshot copy may be at or after
+// startOffset and not in it, so it must be kept.
+func (p *persister) rotateWAL(startOffset int64) error {
+	p.walMu.Lock()
+	defer p.walMu.Unlock()
+
+	tail, err := os.Open(p.walPath())
+	if err != nil {
+		return fmt.Errorf("open wal %s error %s", p.walPath(), err)
+	}
+	if _, err := tail.Seek(startOffset, io.SeekStart); err != nil {
+		tail.Close()
+		return fmt.Errorf("seek wal %s error %s", p.walPath(), err)
+	}
+
+	tmp, err := os.OpenFile(p.walTmpPath(), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		tail.Close()
+		return fmt.Errorf("create wal tmp file error %s", err)
+	}
+	if _, err := io.Copy(tmp, tail); err != nil {
+		tail.Close()
+		tmp.Close()
+		return fmt.Errorf("copy wal tail error %s", err)
+	}
+	tail.Close()
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("fsync wal tmp file error %s", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close wal tmp file error %s", err)
+	}
+
+	if err := p.wal.Close(); err != nil {
+		return fmt.Errorf("close wal error %s", err)
+	}
+	if err := os.Rename(p.walTmpPath(), p.walPath()); err != nil {
+		return fmt.Errorf("rename wal error %s", err)
+	}
+
+	wal, err := os.OpenFile(p.walPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("reopen wal %s error %s", p.walPath(), err)
+	}
+	p.wal = wal
+	return nil
+}
+
+// append encodes rec and writes it to the WAL, length-prefixed so
+// replayWAL can tell where one record ends and the next begins. It is a
+// no-op on a nil persister, i.e. a MemDB created with the plain in-memory
+// constructor.
+func (p *persister) append(rec walRecord) error {
+	if p == nil {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&rec); err != nil {
+		return fmt.Errorf("encode wal record error %s", err)
+	}
+
+	p.walMu.Lock()
+	defer p.walMu.Unlock()
+
+	var lenBuf [4]byte
+	binary.BigEndian.PutUint32(lenBuf[:], uint32(buf.Len()))
+	if _, err := p.wal.Write(lenBuf[:]); err != nil {
+		return fmt.Errorf("write wal record length error %s", err)
+	}
+	if _, err := p.wal.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("write wal record error %s", err)
+	}
+	return p.wal.Sync()
+}
+
+func (p *persister) logCreateDevice(dev *common.Device) error {
+	return p.append(walRecord{Op: opCreateDevice, Device: dev})
+}
+
+func (p *persister) logDeleteDevice(clusterName string, deviceName string) error {
+	return p.append(walRecord{Op: opDeleteDevice, DeleteKey1: clusterName, DeleteKey2: deviceName})
+}
+
+func (p *persister) logCreateService(svc *common.Service) error {
+	return p.append(walRecord{Op: opCreateService, Service: svc})
+}
+
+func (p *persister) logDeleteService(clusterName string, serviceName string) error {
+	return p.append(walRecord{Op: opDeleteService, DeleteKey1: clusterName, DeleteKey2: serviceName})
+}
+
+func (p *persister) logCreateServiceAttr(attr *common.ServiceAttr) error {
+	return p.append(walRecord{Op: opCreateServiceAttr, ServiceAttr: attr})
+}
+
+func (p *persister) logUpdateServiceAttr(attr *common.ServiceAttr) error {
+	return p.append(walRecord{Op: opUpdateServiceAttr, ServiceAttr: attr})
+}
+
+func (p *persister) logDeleteServiceAttr(serviceUUID string) error {
+	return p.append(walRecord{Op: opDeleteServiceAttr, DeleteKey1: serviceUUID})
+}
+
+func (p *persister) logCreateServiceEndpoints(eps *ServiceEndpoints) error {
+	return p.append(walRecord{Op: opCreateServiceEndpoints, ServiceEndpoints: eps})
+}
+
+func (p *persister) logUpdateServiceEndpoints(eps *ServiceEndpoints) error {
+	return p.append(walRecord{Op: opUpdateServiceEndpoints, ServiceEndpoints: eps})
+}
+
+func (p *persister) logDeleteServiceEndpoints(serviceUUID string) error {
+	return p.append(walRecord{Op: opDeleteServiceEndpoints, DeleteKey1: serviceUUID})
+}
+
+func (p *persister) logCreateVolume(vol *common.Volume) error {
+	return p.append(walRecord{Op: opCreateVolume, Volume: vol})
+}
+
+func (p *persister) logUpdateVolume(vol *common.Volume) error {
+	return p.append(walRecord{Op: opUpdateVolume, Volume: vol})
+}
+
+func (p *persister) logDeleteVolume(serviceUUID string, volumeID string) error {
+	return p.append(walRecord{Op: opDeleteVolume, DeleteKey1: serviceUUID, DeleteKey2: volumeID})
+}
+
+func (p *persister) logCreateConfigFile(cfg *common.ConfigFile) error {
+	return p.append(walRecord{Op: opCreateConfigFile, ConfigFile: cfg})
+}
+
+func (p *persister) logDeleteConfigFile(serviceUUID string, fileID string) error {
+	return p.append(walRecord{Op: opDeleteConfigFile, DeleteKey1: serviceUUID, DeleteKey2: fileID})
+}
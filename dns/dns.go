@@ -0,0 +1,11 @@
+package dns
+
+import "errors"
+
+// ErrDomainNotFound is returned when a dns name does not fall under any
+// domain/service dns suffix firecamp knows about.
+var ErrDomainNotFound = errors.New("dns: domain not found")
+
+// ErrDNSProviderNotSupported is returned when the configured dnsprovider.Interface
+// does not support zone management.
+var ErrDNSProviderNotSupported = errors.New("dns: provider does not support zones")
@@ -0,0 +1,268 @@
+// Package aws implements dnsprovider.Interface on top of AWS Route53,
+// preserving the private hosted zone / VPC association behavior firecamp
+// already relied on before the dnsprovider abstraction existed.
+package aws
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
+)
+
+// withTrailingDot returns name as a fully-qualified domain name, ending in
+// a dot. Route53 always stores and returns hosted zone names this way, even
+// when CreateHostedZone is called with a dot-less name, so callers that
+// compare against a dot-less name (e.g. GenDefaultHostedZoneName) never
+// match an existing zone unless both sides are normalized to this form.
+func withTrailingDot(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// VPCOptions is the Route53-specific CreateZoneOptions.ProviderOpts value
+// for a private hosted zone: the VPC the zone should be associated with.
+type VPCOptions struct {
+	VPCID     string
+	VPCRegion string
+}
+
+// Route53DNSProvider implements dnsprovider.Interface against Route53.
+type Route53DNSProvider struct {
+	client *route53.Route53
+}
+
+// NewProvider creates a Route53-backed dnsprovider.Interface.
+func NewProvider(client *route53.Route53) dnsprovider.Interface {
+	return &Route53DNSProvider{client: client}
+}
+
+// Zones implements dnsprovider.Interface.
+func (p *Route53DNSProvider) Zones(ctx context.Context) (dnsprovider.Zones, bool) {
+	return &zones{client: p.client}, true
+}
+
+type zones struct {
+	client *route53.Route53
+}
+
+func (z *zones) List(ctx context.Context) ([]dnsprovider.Zone, error) {
+	var zs []dnsprovider.Zone
+	input := &route53.ListHostedZonesInput{}
+	for {
+		resp, err := z.client.ListHostedZonesWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("route53 ListHostedZones error %s", err)
+		}
+		for _, hz := range resp.HostedZones {
+			zs = append(zs, &zone{client: z.client, id: aws.StringValue(hz.Id), name: aws.StringValue(hz.Name)})
+		}
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.Marker = resp.NextMarker
+	}
+	return zs, nil
+}
+
+func (z *zones) Get(ctx context.Context, name string) (dnsprovider.Zone, error) {
+	zs, err := z.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	want := withTrailingDot(name)
+	for _, zo := range zs {
+		if zo.Name() == want {
+			return zo, nil
+		}
+	}
+	return nil, dnsprovider.ErrZoneNotFound
+}
+
+func (z *zones) GetOrCreate(ctx context.Context, name string, opts dnsprovider.CreateZoneOptions) (dnsprovider.Zone, error) {
+	zo, err := z.Get(ctx, name)
+	if err == nil {
+		return zo, nil
+	}
+	if err != dnsprovider.ErrZoneNotFound {
+		return nil, err
+	}
+
+	input := &route53.CreateHostedZoneInput{
+		Name:            aws.String(name),
+		CallerReference: aws.String(name),
+	}
+	if opts.Private {
+		vpcOpts, ok := opts.ProviderOpts.(VPCOptions)
+		if !ok {
+			return nil, fmt.Errorf("route53 private zone requires aws.VPCOptions")
+		}
+		input.VPC = &route53.VPC{
+			VPCId:     aws.String(vpcOpts.VPCID),
+			VPCRegion: aws.String(vpcOpts.VPCRegion),
+		}
+	}
+
+	resp, err := z.client.CreateHostedZoneWithContext(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("route53 CreateHostedZone %s error %s", name, err)
+	}
+
+	glog.Infoln("created route53 hosted zone", name, "id", aws.StringValue(resp.HostedZone.Id))
+	return &zone{client: z.client, id: aws.StringValue(resp.HostedZone.Id), name: withTrailingDot(name)}, nil
+}
+
+func (z *zones) Remove(ctx context.Context, zo dnsprovider.Zone) error {
+	_, err := z.client.DeleteHostedZoneWithContext(ctx, &route53.DeleteHostedZoneInput{Id: aws.String(zo.ID())})
+	if err != nil {
+		return fmt.Errorf("route53 DeleteHostedZone %s error %s", zo.ID(), err)
+	}
+	return nil
+}
+
+type zone struct {
+	client *route53.Route53
+	id     string
+	name   string
+}
+
+func (z *zone) Name() string { return z.name }
+func (z *zone) ID() string   { return z.id }
+
+func (z *zone) ResourceRecordSets(ctx context.Context) (dnsprovider.ResourceRecordSets, error) {
+	return &resourceRecordSets{client: z.client, zone: z}, nil
+}
+
+type resourceRecordSets struct {
+	client *route53.Route53
+	zone   *zone
+}
+
+func (r *resourceRecordSets) List(ctx context.Context) ([]dnsprovider.ResourceRecordSet, error) {
+	var out []dnsprovider.ResourceRecordSet
+	input := &route53.ListResourceRecordSetsInput{HostedZoneId: aws.String(r.zone.id)}
+	for {
+		resp, err := r.client.ListResourceRecordSetsWithContext(ctx, input)
+		if err != nil {
+			return nil, fmt.Errorf("route53 ListResourceRecordSets %s error %s", r.zone.id, err)
+		}
+		out = append(out, toRrsets(resp.ResourceRecordSets)...)
+		if !aws.BoolValue(resp.IsTruncated) {
+			break
+		}
+		input.StartRecordName = resp.NextRecordName
+		input.StartRecordType = resp.NextRecordType
+		input.StartRecordIdentifier = resp.NextRecordIdentifier
+	}
+	return out, nil
+}
+
+func (r *resourceRecordSets) Get(ctx context.Context, name string) ([]dnsprovider.ResourceRecordSet, error) {
+	all, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []dnsprovider.ResourceRecordSet
+	want := withTrailingDot(name)
+	for _, rrs := range all {
+		if withTrailingDot(rrs.Name()) == want {
+			matched = append(matched, rrs)
+		}
+	}
+	return matched, nil
+}
+
+func (r *resourceRecordSets) New(name string, rrdatas []string, ttl int64, rrsType dnsprovider.RrsType) dnsprovider.ResourceRecordSet {
+	return &resourceRecordSet{name: name, rrdatas: rrdatas, ttl: ttl, rrsType: rrsType}
+}
+
+func (r *resourceRecordSets) StartChangeset() dnsprovider.ResourceRecordChangeset {
+	return &changeset{client: r.client, zoneID: r.zone.id}
+}
+
+func (r *resourceRecordSets) Zone() dnsprovider.Zone { return r.zone }
+
+func toRrsets(in []*route53.ResourceRecordSet) []dnsprovider.ResourceRecordSet {
+	out := make([]dnsprovider.ResourceRecordSet, len(in))
+	for i, rrs := range in {
+		rrdatas := make([]string, len(rrs.ResourceRecords))
+		for j, rr := range rrs.ResourceRecords {
+			rrdatas[j] = aws.StringValue(rr.Value)
+		}
+		out[i] = &resourceRecordSet{
+			name:    aws.StringValue(rrs.Name),
+			rrdatas: rrdatas,
+			ttl:     aws.Int64Value(rrs.TTL),
+			rrsType: dnsprovider.RrsType(aws.StringValue(rrs.Type)),
+		}
+	}
+	return out
+}
+
+type resourceRecordSet struct {
+	name    string
+	rrdatas []string
+	ttl     int64
+	rrsType dnsprovider.RrsType
+}
+
+func (r *resourceRecordSet) Name() string              { return r.name }
+func (r *resourceRecordSet) Rrdatas() []string         { return r.rrdatas }
+func (r *resourceRecordSet) Ttl() int64                { return r.ttl }
+func (r *resourceRecordSet) Type() dnsprovider.RrsType { return r.rrsType }
+
+type changeset struct {
+	client  *route53.Route53
+	zoneID  string
+	changes []*route53.Change
+}
+
+func (c *changeset) add(action string, rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	rrs := &route53.ResourceRecordSet{
+		Name: aws.String(rrset.Name()),
+		Type: aws.String(string(rrset.Type())),
+		TTL:  aws.Int64(rrset.Ttl()),
+	}
+	for _, v := range rrset.Rrdatas() {
+		rrs.ResourceRecords = append(rrs.ResourceRecords, &route53.ResourceRecord{Value: aws.String(v)})
+	}
+	c.changes = append(c.changes, &route53.Change{
+		Action:            aws.String(action),
+		ResourceRecordSet: rrs,
+	})
+	return c
+}
+
+func (c *changeset) Add(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	return c.add(route53.ChangeActionCreate, rrset)
+}
+
+func (c *changeset) Remove(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	return c.add(route53.ChangeActionDelete, rrset)
+}
+
+func (c *changeset) Upsert(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	return c.add(route53.ChangeActionUpsert, rrset)
+}
+
+func (c *changeset) Apply(ctx context.Context) error {
+	if len(c.changes) == 0 {
+		return nil
+	}
+
+	_, err := c.client.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		HostedZoneId: aws.String(c.zoneID),
+		ChangeBatch:  &route53.ChangeBatch{Changes: c.changes},
+	})
+	if err != nil {
+		return fmt.Errorf("route53 ChangeResourceRecordSets %s error %s", c.zoneID, err)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package aws
+
+import "testing"
+
+func TestWithTrailingDot(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "example.com."},
+		{"example.com.", "example.com."},
+		{"", "."},
+	}
+	for _, c := range cases {
+		if got := withTrailingDot(c.in); got != c.want {
+			t.Errorf("withTrailingDot(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// TestZonesGetMatchesDotLessName checks the comparison zones.Get makes,
+// without calling Route53: a dot-less hosted zone name, the form every
+// caller in this repo passes (GenDefaultHostedZoneName and friends never
+// add a trailing dot), normalized with withTrailingDot, equals the
+// always-fully-qualified, trailing-dot name Route53 reports. Before this was fixed,
+// Get never found the zone it had itself just created, so GetOrCreate
+// created a brand-new hosted zone on every call.
+func TestZonesGetMatchesDotLessName(t *testing.T) {
+	routeName := "example.com."
+	callerName := "example.com"
+	if routeName != withTrailingDot(callerName) {
+		t.Errorf("expected %q to match %q once normalized", routeName, callerName)
+	}
+}
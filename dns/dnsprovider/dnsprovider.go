@@ -0,0 +1,115 @@
+// Package dnsprovider abstracts the DNS backend that the dns package
+// registers service member records against. The shape follows the
+// Kubernetes federation dnsprovider package: a Provider hands out a Zones
+// collection, a Zone hands out a ResourceRecordSets collection, and record
+// mutations go through a ResourceRecordChangeset so a batch of add/remove/
+// upsert operations commits atomically.
+//
+// Concrete backends (Route53, Google Cloud DNS, an etcd-backed provider for
+// CoreDNS) live in subpackages and are never referenced by name outside of
+// the code that constructs them, so the rest of firecamp works against any
+// of them interchangeably.
+package dnsprovider
+
+import (
+	"errors"
+
+	"golang.org/x/net/context"
+)
+
+// ErrZoneNotFound is returned by Zones.Get when no zone matches the name.
+var ErrZoneNotFound = errors.New("dnsprovider: zone not found")
+
+// Interface is a DNS provider backend.
+type Interface interface {
+	// Zones returns the provider's hosted zone collection. ok is false if
+	// the provider does not support zone management.
+	Zones(ctx context.Context) (zones Zones, ok bool)
+}
+
+// Zones manages the hosted zones known to a provider.
+type Zones interface {
+	// List lists all hosted zones visible to the provider's credentials.
+	List(ctx context.Context) ([]Zone, error)
+	// Get returns the zone with the given domain name.
+	Get(ctx context.Context, name string) (Zone, error)
+	// GetOrCreate returns the zone with the given domain name, creating it
+	// with opts if it does not already exist.
+	GetOrCreate(ctx context.Context, name string, opts CreateZoneOptions) (Zone, error)
+	// Remove deletes a zone.
+	Remove(ctx context.Context, zone Zone) error
+}
+
+// CreateZoneOptions carries the options needed to create a zone. Options
+// that only make sense for one provider are passed through ProviderOpts
+// rather than being added here, so this struct stays provider-agnostic.
+type CreateZoneOptions struct {
+	// Private marks the zone as only resolvable from within the network(s)
+	// named by ProviderOpts, e.g. a VPC.
+	Private bool
+	// ProviderOpts carries provider-specific creation options, e.g. AWS's
+	// VPCOptions{VPCID, VPCRegion}. Callers that do not special-case a
+	// provider leave this nil.
+	ProviderOpts interface{}
+}
+
+// Zone is a single hosted zone, e.g. a Route53 hosted zone or a Google
+// Cloud DNS managed zone.
+type Zone interface {
+	// Name is the zone's domain name. The Route53 and Cloud DNS providers
+	// report it fully qualified, with a trailing dot (e.g. "example.com.");
+	// the etcd provider returns it exactly as it was passed in.
+	Name() string
+	// ID is the provider-specific zone identifier.
+	ID() string
+	// ResourceRecordSets returns the record collection for this zone.
+	ResourceRecordSets(ctx context.Context) (ResourceRecordSets, error)
+}
+
+// RrsType is the resource record set type.
+type RrsType string
+
+// Record types firecamp registers. Providers may support more, but these
+// are the only ones the dns package itself generates.
+const (
+	RrsTypeA     RrsType = "A"
+	RrsTypeCNAME RrsType = "CNAME"
+)
+
+// ResourceRecordSets manages the records within a single zone.
+type ResourceRecordSets interface {
+	// List lists all records in the zone.
+	List(ctx context.Context) ([]ResourceRecordSet, error)
+	// Get returns the records registered under name, if any.
+	Get(ctx context.Context, name string) ([]ResourceRecordSet, error)
+	// New creates a detached ResourceRecordSet for use in a changeset.
+	New(name string, rrdatas []string, ttl int64, rrsType RrsType) ResourceRecordSet
+	// StartChangeset begins a batch of add/remove/upsert operations that
+	// commit together when Apply is called.
+	StartChangeset() ResourceRecordChangeset
+	// Zone returns the owning zone.
+	Zone() Zone
+}
+
+// ResourceRecordSet is one DNS record, e.g. a single A record with one or
+// more IPs.
+type ResourceRecordSet interface {
+	Name() string
+	Rrdatas() []string
+	Ttl() int64
+	Type() RrsType
+}
+
+// ResourceRecordChangeset batches record mutations so they are applied to
+// the provider as a single atomic request.
+type ResourceRecordChangeset interface {
+	// Add queues rrset for creation.
+	Add(rrset ResourceRecordSet) ResourceRecordChangeset
+	// Remove queues rrset for deletion.
+	Remove(rrset ResourceRecordSet) ResourceRecordChangeset
+	// Upsert queues rrset for creation or, if a record of the same name and
+	// type already exists, replacement.
+	Upsert(rrset ResourceRecordSet) ResourceRecordChangeset
+	// Apply commits the queued changes.
+	Apply(ctx context.Context) error
+}
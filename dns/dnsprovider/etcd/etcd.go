@@ -0,0 +1,271 @@
+// Package etcd implements dnsprovider.Interface against an etcd cluster, in
+// the key layout CoreDNS's etcd plugin expects, so on-prem or dev firecamp
+// deployments can serve cluster service dns without a cloud DNS dependency.
+//
+// CoreDNS's etcd plugin stores one JSON-encoded message per key, with the
+// key being the dns name's labels reversed and dot-joined under a
+// configurable path prefix, e.g. db-0.cluster1.svcs.example.com is stored
+// under /skydns/com/example/svcs/cluster1/db-0.
+package etcd
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/etcd/clientv3"
+	"golang.org/x/net/context"
+
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
+)
+
+// DefaultPathPrefix is CoreDNS's default etcd plugin path prefix.
+const DefaultPathPrefix = "/skydns"
+
+// message is the record format CoreDNS's etcd plugin reads.
+type message struct {
+	Host string `json:"host"`
+	TTL  int64  `json:"ttl,omitempty"`
+}
+
+// EtcdDNSProvider implements dnsprovider.Interface against etcd.
+type EtcdDNSProvider struct {
+	client     *clientv3.Client
+	pathPrefix string
+}
+
+// NewProvider creates an etcd-backed dnsprovider.Interface. pathPrefix
+// should match the etcd plugin's "path" setting in the Corefile; pass "" to
+// use DefaultPathPrefix.
+func NewProvider(client *clientv3.Client, pathPrefix string) dnsprovider.Interface {
+	if pathPrefix == "" {
+		pathPrefix = DefaultPathPrefix
+	}
+	return &EtcdDNSProvider{client: client, pathPrefix: pathPrefix}
+}
+
+// Zones implements dnsprovider.Interface. etcd has no native notion of a
+// hosted zone; a "zone" here is just the domain name under which records
+// are considered registered, and CreateZoneOptions is ignored since there
+// is nothing to provision.
+func (p *EtcdDNSProvider) Zones(ctx context.Context) (dnsprovider.Zones, bool) {
+	return &zones{client: p.client, pathPrefix: p.pathPrefix}, true
+}
+
+type zones struct {
+	client     *clientv3.Client
+	pathPrefix string
+}
+
+func (z *zones) zoneKey(name string) string {
+	return z.pathPrefix + "/" + reverseLabels(name)
+}
+
+func reverseLabels(dnsname string) string {
+	labels := strings.Split(strings.TrimSuffix(dnsname, "."), ".")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, "/")
+}
+
+// List is not supported against a raw etcd keyspace without walking every
+// key under pathPrefix; firecamp only ever needs Get/GetOrCreate, so this
+// returns an empty list rather than scanning the whole tree.
+func (z *zones) List(ctx context.Context) ([]dnsprovider.Zone, error) {
+	return nil, nil
+}
+
+func (z *zones) Get(ctx context.Context, name string) (dnsprovider.Zone, error) {
+	// A zone "exists" in etcd once its own placeholder record does. This
+	// mirrors how CoreDNS's etcd plugin has no explicit zone creation step.
+	resp, err := z.client.Get(ctx, z.zoneKey(name))
+	if err != nil {
+		return nil, fmt.Errorf("etcd Get zone %s error %s", name, err)
+	}
+	if resp.Count == 0 {
+		return nil, dnsprovider.ErrZoneNotFound
+	}
+	return &zone{client: z.client, pathPrefix: z.pathPrefix, name: name}, nil
+}
+
+func (z *zones) GetOrCreate(ctx context.Context, name string, opts dnsprovider.CreateZoneOptions) (dnsprovider.Zone, error) {
+	zo, err := z.Get(ctx, name)
+	if err == nil {
+		return zo, nil
+	}
+	if err != dnsprovider.ErrZoneNotFound {
+		return nil, err
+	}
+
+	msg, err := json.Marshal(message{Host: name})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := z.client.Put(ctx, z.zoneKey(name), string(msg)); err != nil {
+		return nil, fmt.Errorf("etcd Put zone %s error %s", name, err)
+	}
+	return &zone{client: z.client, pathPrefix: z.pathPrefix, name: name}, nil
+}
+
+func (z *zones) Remove(ctx context.Context, zo dnsprovider.Zone) error {
+	if _, err := z.client.Delete(ctx, z.zoneKey(zo.Name()), clientv3.WithPrefix()); err != nil {
+		return fmt.Errorf("etcd Delete zone %s error %s", zo.Name(), err)
+	}
+	return nil
+}
+
+type zone struct {
+	client     *clientv3.Client
+	pathPrefix string
+	name       string
+}
+
+func (z *zone) Name() string { return z.name }
+func (z *zone) ID() string   { return z.name }
+
+func (z *zone) ResourceRecordSets(ctx context.Context) (dnsprovider.ResourceRecordSets, error) {
+	return &resourceRecordSets{client: z.client, pathPrefix: z.pathPrefix, zone: z}, nil
+}
+
+type resourceRecordSets struct {
+	client     *clientv3.Client
+	pathPrefix string
+	zone       *zone
+}
+
+func (r *resourceRecordSets) key(name string) string {
+	return r.pathPrefix + "/" + reverseLabels(name)
+}
+
+func (r *resourceRecordSets) List(ctx context.Context) ([]dnsprovider.ResourceRecordSet, error) {
+	resp, err := r.client.Get(ctx, r.pathPrefix+"/"+reverseLabels(r.zone.name), clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("etcd List records under %s error %s", r.zone.name, err)
+	}
+
+	var out []dnsprovider.ResourceRecordSet
+	for _, kv := range resp.Kvs {
+		var msg message
+		if err := json.Unmarshal(kv.Value, &msg); err != nil {
+			continue
+		}
+		out = append(out, &resourceRecordSet{name: r.zone.name, rrdatas: []string{msg.Host}, ttl: msg.TTL, rrsType: dnsprovider.RrsTypeA})
+	}
+	return out, nil
+}
+
+// Get reads every sub-key stored under name (one per rrdata - see Apply)
+// and merges them back into the single multi-rrdata ResourceRecordSet the
+// dnsprovider interface models.
+func (r *resourceRecordSets) Get(ctx context.Context, name string) ([]dnsprovider.ResourceRecordSet, error) {
+	resp, err := r.client.Get(ctx, r.key(name)+"/", clientv3.WithPrefix())
+	if err != nil {
+		return nil, fmt.Errorf("etcd Get record %s error %s", name, err)
+	}
+
+	var rrdatas []string
+	var ttl int64
+	for _, kv := range resp.Kvs {
+		var msg message
+		if err := json.Unmarshal(kv.Value, &msg); err != nil {
+			continue
+		}
+		rrdatas = append(rrdatas, msg.Host)
+		ttl = msg.TTL
+	}
+	if len(rrdatas) == 0 {
+		return nil, nil
+	}
+	return []dnsprovider.ResourceRecordSet{&resourceRecordSet{name: name, rrdatas: rrdatas, ttl: ttl, rrsType: dnsprovider.RrsTypeA}}, nil
+}
+
+func (r *resourceRecordSets) New(name string, rrdatas []string, ttl int64, rrsType dnsprovider.RrsType) dnsprovider.ResourceRecordSet {
+	return &resourceRecordSet{name: name, rrdatas: rrdatas, ttl: ttl, rrsType: rrsType}
+}
+
+func (r *resourceRecordSets) StartChangeset() dnsprovider.ResourceRecordChangeset {
+	return &changeset{client: r.client, rrsets: r}
+}
+
+func (r *resourceRecordSets) Zone() dnsprovider.Zone { return r.zone }
+
+type resourceRecordSet struct {
+	name    string
+	rrdatas []string
+	ttl     int64
+	rrsType dnsprovider.RrsType
+}
+
+func (r *resourceRecordSet) Name() string              { return r.name }
+func (r *resourceRecordSet) Rrdatas() []string         { return r.rrdatas }
+func (r *resourceRecordSet) Ttl() int64                { return r.ttl }
+func (r *resourceRecordSet) Type() dnsprovider.RrsType { return r.rrsType }
+
+type op struct {
+	remove bool
+	rrset  dnsprovider.ResourceRecordSet
+}
+
+type changeset struct {
+	client *clientv3.Client
+	rrsets *resourceRecordSets
+	ops    []op
+}
+
+func (c *changeset) Add(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, op{rrset: rrset})
+	return c
+}
+
+func (c *changeset) Remove(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, op{remove: true, rrset: rrset})
+	return c
+}
+
+func (c *changeset) Upsert(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, op{rrset: rrset})
+	return c
+}
+
+// Apply commits every queued op inside a single etcd transaction so the
+// batch is visible to CoreDNS atomically.
+func (c *changeset) Apply(ctx context.Context) error {
+	if len(c.ops) == 0 {
+		return nil
+	}
+
+	var thenOps []clientv3.Op
+	for _, o := range c.ops {
+		key := c.rrsets.key(o.rrset.Name())
+		if o.remove {
+			thenOps = append(thenOps, clientv3.OpDelete(key+"/", clientv3.WithPrefix()))
+			continue
+		}
+		rrdatas := o.rrset.Rrdatas()
+		if len(rrdatas) == 0 {
+			continue
+		}
+
+		// Every rrdata gets its own sub-key under key, the same mechanism
+		// CoreDNS's etcd plugin uses for round-robin records at one name;
+		// a single key per name would silently drop every rrdata past the
+		// first. The prefix delete clears whatever sub-keys a previous
+		// rrset at this name held, so a rrdata no longer present in the new
+		// set (e.g. a member that went unhealthy) does not linger.
+		thenOps = append(thenOps, clientv3.OpDelete(key+"/", clientv3.WithPrefix()))
+		for i, host := range rrdatas {
+			msg, err := json.Marshal(message{Host: host, TTL: o.rrset.Ttl()})
+			if err != nil {
+				return err
+			}
+			thenOps = append(thenOps, clientv3.OpPut(fmt.Sprintf("%s/%d", key, i), string(msg)))
+		}
+	}
+
+	_, err := c.client.Txn(ctx).Then(thenOps...).Commit()
+	if err != nil {
+		return fmt.Errorf("etcd changeset commit error %s", err)
+	}
+	return nil
+}
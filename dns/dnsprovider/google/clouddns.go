@@ -0,0 +1,261 @@
+// Package google implements dnsprovider.Interface on top of Google Cloud
+// DNS, so firecamp clusters running on GCE do not need a Route53 hosted
+// zone.
+package google
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	gdns "google.golang.org/api/dns/v1"
+
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
+)
+
+// withTrailingDot returns name as a fully-qualified domain name, ending in
+// a dot. Cloud DNS requires a managed zone's DnsName to end in a dot and
+// always returns it that way, so callers that compare against a dot-less
+// name (e.g. GenDefaultHostedZoneName) never match an existing zone unless
+// both sides are normalized to this form.
+func withTrailingDot(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+// CloudDNSProvider implements dnsprovider.Interface against Google Cloud DNS.
+type CloudDNSProvider struct {
+	project string
+	service *gdns.Service
+}
+
+// NewProvider creates a Google Cloud DNS-backed dnsprovider.Interface for
+// the given GCE project.
+func NewProvider(project string, service *gdns.Service) dnsprovider.Interface {
+	return &CloudDNSProvider{project: project, service: service}
+}
+
+// Zones implements dnsprovider.Interface. Google Cloud DNS has no notion of
+// a VPC-private zone the way Route53 does, so CreateZoneOptions.Private is
+// ignored.
+func (p *CloudDNSProvider) Zones(ctx context.Context) (dnsprovider.Zones, bool) {
+	return &zones{project: p.project, service: p.service}, true
+}
+
+type zones struct {
+	project string
+	service *gdns.Service
+}
+
+func managedZoneName(domain string) string {
+	// Cloud DNS managed zone names must be DNS-label safe; dots are not
+	// allowed, so use the domain with dots replaced by dashes. The trailing
+	// dot Cloud DNS always reports in a zone's DnsName is stripped first, so
+	// this returns the same managed zone resource name whether domain came
+	// from a caller's dot-less name or a Zone.Name() read back from the API.
+	domain = strings.TrimSuffix(domain, ".")
+	out := make([]byte, len(domain))
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '.' {
+			out[i] = '-'
+		} else {
+			out[i] = domain[i]
+		}
+	}
+	return string(out)
+}
+
+func (z *zones) List(ctx context.Context) ([]dnsprovider.Zone, error) {
+	var zs []dnsprovider.Zone
+	err := z.service.ManagedZones.List(z.project).Pages(ctx, func(resp *gdns.ManagedZonesListResponse) error {
+		for _, mz := range resp.ManagedZones {
+			zs = append(zs, &zone{project: z.project, service: z.service, id: fmt.Sprintf("%d", mz.Id), name: mz.DnsName})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clouddns ManagedZones.List error %s", err)
+	}
+	return zs, nil
+}
+
+func (z *zones) Get(ctx context.Context, name string) (dnsprovider.Zone, error) {
+	zs, err := z.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	want := withTrailingDot(name)
+	for _, zo := range zs {
+		if zo.Name() == want {
+			return zo, nil
+		}
+	}
+	return nil, dnsprovider.ErrZoneNotFound
+}
+
+func (z *zones) GetOrCreate(ctx context.Context, name string, opts dnsprovider.CreateZoneOptions) (dnsprovider.Zone, error) {
+	zo, err := z.Get(ctx, name)
+	if err == nil {
+		return zo, nil
+	}
+	if err != dnsprovider.ErrZoneNotFound {
+		return nil, err
+	}
+
+	mz := &gdns.ManagedZone{
+		Name:        managedZoneName(name),
+		DnsName:     withTrailingDot(name),
+		Description: "firecamp cluster service dns zone",
+	}
+	created, err := z.service.ManagedZones.Create(z.project, mz).Do()
+	if err != nil {
+		return nil, fmt.Errorf("clouddns ManagedZones.Create %s error %s", name, err)
+	}
+
+	return &zone{project: z.project, service: z.service, id: fmt.Sprintf("%d", created.Id), name: withTrailingDot(name)}, nil
+}
+
+func (z *zones) Remove(ctx context.Context, zo dnsprovider.Zone) error {
+	err := z.service.ManagedZones.Delete(z.project, managedZoneName(zo.Name())).Do()
+	if err != nil {
+		return fmt.Errorf("clouddns ManagedZones.Delete %s error %s", zo.Name(), err)
+	}
+	return nil
+}
+
+type zone struct {
+	project string
+	service *gdns.Service
+	id      string
+	name    string
+}
+
+func (z *zone) Name() string { return z.name }
+func (z *zone) ID() string   { return z.id }
+
+func (z *zone) ResourceRecordSets(ctx context.Context) (dnsprovider.ResourceRecordSets, error) {
+	return &resourceRecordSets{project: z.project, service: z.service, zone: z}, nil
+}
+
+type resourceRecordSets struct {
+	project string
+	service *gdns.Service
+	zone    *zone
+}
+
+func (r *resourceRecordSets) List(ctx context.Context) ([]dnsprovider.ResourceRecordSet, error) {
+	var out []dnsprovider.ResourceRecordSet
+	err := r.service.ResourceRecordSets.List(r.project, managedZoneName(r.zone.name)).Pages(ctx, func(resp *gdns.ResourceRecordSetsListResponse) error {
+		for _, rrs := range resp.Rrsets {
+			out = append(out, &resourceRecordSet{name: rrs.Name, rrdatas: rrs.Rrdatas, ttl: rrs.Ttl, rrsType: dnsprovider.RrsType(rrs.Type)})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("clouddns ResourceRecordSets.List %s error %s", r.zone.name, err)
+	}
+	return out, nil
+}
+
+func (r *resourceRecordSets) Get(ctx context.Context, name string) ([]dnsprovider.ResourceRecordSet, error) {
+	all, err := r.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var matched []dnsprovider.ResourceRecordSet
+	want := withTrailingDot(name)
+	for _, rrs := range all {
+		if withTrailingDot(rrs.Name()) == want {
+			matched = append(matched, rrs)
+		}
+	}
+	return matched, nil
+}
+
+func (r *resourceRecordSets) New(name string, rrdatas []string, ttl int64, rrsType dnsprovider.RrsType) dnsprovider.ResourceRecordSet {
+	return &resourceRecordSet{name: name, rrdatas: rrdatas, ttl: ttl, rrsType: rrsType}
+}
+
+func (r *resourceRecordSets) StartChangeset() dnsprovider.ResourceRecordChangeset {
+	return &changeset{rrsets: r, project: r.project, service: r.service, zoneName: managedZoneName(r.zone.name)}
+}
+
+func (r *resourceRecordSets) Zone() dnsprovider.Zone { return r.zone }
+
+type resourceRecordSet struct {
+	name    string
+	rrdatas []string
+	ttl     int64
+	rrsType dnsprovider.RrsType
+}
+
+func (r *resourceRecordSet) Name() string              { return r.name }
+func (r *resourceRecordSet) Rrdatas() []string         { return r.rrdatas }
+func (r *resourceRecordSet) Ttl() int64                { return r.ttl }
+func (r *resourceRecordSet) Type() dnsprovider.RrsType { return r.rrsType }
+
+type changeset struct {
+	rrsets   *resourceRecordSets
+	project  string
+	service  *gdns.Service
+	zoneName string
+	change   gdns.Change
+	upserts  []dnsprovider.ResourceRecordSet
+}
+
+func toGoogleRrset(rrset dnsprovider.ResourceRecordSet) *gdns.ResourceRecordSet {
+	return &gdns.ResourceRecordSet{
+		Name:    rrset.Name(),
+		Type:    string(rrset.Type()),
+		Ttl:     rrset.Ttl(),
+		Rrdatas: rrset.Rrdatas(),
+	}
+}
+
+func (c *changeset) Add(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.change.Additions = append(c.change.Additions, toGoogleRrset(rrset))
+	return c
+}
+
+func (c *changeset) Remove(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.change.Deletions = append(c.change.Deletions, toGoogleRrset(rrset))
+	return c
+}
+
+// Upsert defers to Apply, which looks up any record currently published
+// under rrset's name so the deletion entry it queues exactly matches what
+// Cloud DNS has on file; Changes.create rejects a deletion that does not
+// exact-match an existing record (and rejects one when nothing exists yet),
+// so there is no ttl/rrdata to get right until Apply runs with a ctx.
+func (c *changeset) Upsert(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.upserts = append(c.upserts, rrset)
+	return c
+}
+
+func (c *changeset) Apply(ctx context.Context) error {
+	for _, rrset := range c.upserts {
+		existing, err := c.rrsets.Get(ctx, rrset.Name())
+		if err != nil {
+			return fmt.Errorf("clouddns lookup existing record %s error %s", rrset.Name(), err)
+		}
+		for _, e := range existing {
+			if e.Type() != rrset.Type() {
+				continue
+			}
+			c.change.Deletions = append(c.change.Deletions, toGoogleRrset(e))
+		}
+		c.change.Additions = append(c.change.Additions, toGoogleRrset(rrset))
+	}
+
+	if len(c.change.Additions) == 0 && len(c.change.Deletions) == 0 {
+		return nil
+	}
+
+	_, err := c.service.Changes.Create(c.project, c.zoneName, &c.change).Do()
+	if err != nil {
+		return fmt.Errorf("clouddns Changes.Create %s error %s", c.zoneName, err)
+	}
+	return nil
+}
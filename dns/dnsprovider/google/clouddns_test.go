@@ -0,0 +1,31 @@
+package google
+
+import "testing"
+
+func TestWithTrailingDot(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{"example.com", "example.com."},
+		{"example.com.", "example.com."},
+	}
+	for _, c := range cases {
+		if got := withTrailingDot(c.in); got != c.want {
+			t.Errorf("withTrailingDot(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
+
+// TestManagedZoneNameStripsTrailingDot checks that managedZoneName produces
+// the same Cloud DNS managed zone resource name whether it is given the
+// caller's dot-less zone name (at creation) or the trailing-dot name Cloud
+// DNS always reports back through Zone.Name() (at removal); otherwise
+// Remove would look up a managed zone name that was never created.
+func TestManagedZoneNameStripsTrailingDot(t *testing.T) {
+	atCreate := managedZoneName("example.com")
+	atRemove := managedZoneName("example.com.")
+	if atCreate != atRemove {
+		t.Errorf("managedZoneName(%q) = %q, managedZoneName(%q) = %q, want equal", "example.com", atCreate, "example.com.", atRemove)
+	}
+}
@@ -0,0 +1,116 @@
+package dns
+
+import (
+	"golang.org/x/net/context"
+
+	"github.com/cloudstax/openmanage/db"
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
+)
+
+// endpointRecordTTL is the TTL used for the per-member, per-AZ, per-region
+// and global aggregate records the reconciler maintains. It is kept low so
+// an unhealthy member drops out of rotation quickly once its record changes.
+const endpointRecordTTL = 180
+
+// globalAggregateLabel names the record that aggregates every healthy
+// member across all AZs and regions.
+const globalAggregateLabel = "global"
+
+// ReconcileServiceDNS reconciles the dns records for one service against
+// its current db.ServiceEndpoints: one A record per healthy member, an
+// aggregate A record per AZ with every healthy member's IP in that AZ, one
+// aggregate per region, and one global aggregate across all healthy
+// members. A member that is unhealthy, or whose IP changed because its
+// common.Volume.ServerInstanceID moved, is dropped from every aggregate it
+// was part of; a scope whose last healthy member disappears has its record
+// removed entirely rather than left stale.
+func ReconcileServiceDNS(ctx context.Context, dbIns db.DB, serviceUUID string, serviceDNSSuffix string, zone dnsprovider.Zone) error {
+	eps, err := dbIns.GetServiceEndpoints(ctx, serviceUUID)
+	if err != nil {
+		return err
+	}
+
+	rrsets, err := zone.ResourceRecordSets(ctx)
+	if err != nil {
+		return err
+	}
+
+	changeset := rrsets.StartChangeset()
+
+	azIPs := make(map[string][]string)
+	regionIPs := make(map[string][]string)
+	azSeen := make(map[string]bool)
+	regionSeen := make(map[string]bool)
+	var globalIPs []string
+
+	for _, ep := range eps.Endpoints {
+		memberName := GenDNSName(ep.MemberName, serviceDNSSuffix)
+		azSeen[ep.AvailableZone] = true
+		regionSeen[ep.Region] = true
+
+		if !ep.Healthy {
+			if err := removeRecord(ctx, rrsets, changeset, memberName); err != nil {
+				return err
+			}
+			continue
+		}
+
+		changeset.Upsert(rrsets.New(memberName, []string{ep.IP}, endpointRecordTTL, dnsprovider.RrsTypeA))
+		azIPs[ep.AvailableZone] = append(azIPs[ep.AvailableZone], ep.IP)
+		regionIPs[ep.Region] = append(regionIPs[ep.Region], ep.IP)
+		globalIPs = append(globalIPs, ep.IP)
+	}
+
+	if err := reconcileAggregates(ctx, rrsets, changeset, azSeen, azIPs, serviceDNSSuffix, "az"); err != nil {
+		return err
+	}
+	if err := reconcileAggregates(ctx, rrsets, changeset, regionSeen, regionIPs, serviceDNSSuffix, "region"); err != nil {
+		return err
+	}
+
+	globalName := GenDNSName(globalAggregateLabel, serviceDNSSuffix)
+	if len(globalIPs) == 0 {
+		if err := removeRecord(ctx, rrsets, changeset, globalName); err != nil {
+			return err
+		}
+	} else {
+		changeset.Upsert(rrsets.New(globalName, globalIPs, endpointRecordTTL, dnsprovider.RrsTypeA))
+	}
+
+	return changeset.Apply(ctx)
+}
+
+// reconcileAggregates queues an upsert for every scope key that still has
+// healthy IPs, and a removal for every scope key that was seen (i.e. had at
+// least one member, healthy or not) but now has none, so a scope does not
+// linger once its last healthy member disappears.
+func reconcileAggregates(ctx context.Context, rrsets dnsprovider.ResourceRecordSets, changeset dnsprovider.ResourceRecordChangeset, seen map[string]bool, ipsByKey map[string][]string, serviceDNSSuffix string, scopeLabel string) error {
+	for key := range seen {
+		name := scopeLabel + dnsNameSeparator + key + dnsNameSeparator + serviceDNSSuffix
+		ips := ipsByKey[key]
+		if len(ips) == 0 {
+			if err := removeRecord(ctx, rrsets, changeset, name); err != nil {
+				return err
+			}
+			continue
+		}
+		changeset.Upsert(rrsets.New(name, ips, endpointRecordTTL, dnsprovider.RrsTypeA))
+	}
+	return nil
+}
+
+// removeRecord fetches name's current rrset and queues it for removal.
+// Both Route53 and Cloud DNS require a deletion to exactly match the
+// record's existing rrdata, so queuing a removal built from scratch (e.g.
+// with no rrdata) is rejected by the real APIs; a name with no existing
+// record is left alone.
+func removeRecord(ctx context.Context, rrsets dnsprovider.ResourceRecordSets, changeset dnsprovider.ResourceRecordChangeset, name string) error {
+	existing, err := rrsets.Get(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, rrset := range existing {
+		changeset.Remove(rrset)
+	}
+	return nil
+}
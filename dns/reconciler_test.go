@@ -0,0 +1,201 @@
+package dns
+
+import (
+	"testing"
+
+	"golang.org/x/net/context"
+
+	"github.com/cloudstax/openmanage/db"
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
+)
+
+// fakeRRSets is a minimal in-memory dnsprovider.ResourceRecordSets, enough
+// to exercise ReconcileServiceDNS's upsert/remove logic without a real DNS
+// backend. Unlike the real backends, Get only ever needs to report the
+// record this fake itself is holding, since there is no pagination to get
+// wrong here.
+type fakeRRSets struct {
+	records map[string]dnsprovider.ResourceRecordSet
+}
+
+func newFakeRRSets() *fakeRRSets {
+	return &fakeRRSets{records: make(map[string]dnsprovider.ResourceRecordSet)}
+}
+
+func (f *fakeRRSets) List(ctx context.Context) ([]dnsprovider.ResourceRecordSet, error) {
+	var out []dnsprovider.ResourceRecordSet
+	for _, rrs := range f.records {
+		out = append(out, rrs)
+	}
+	return out, nil
+}
+
+func (f *fakeRRSets) Get(ctx context.Context, name string) ([]dnsprovider.ResourceRecordSet, error) {
+	if rrs, ok := f.records[name]; ok {
+		return []dnsprovider.ResourceRecordSet{rrs}, nil
+	}
+	return nil, nil
+}
+
+func (f *fakeRRSets) New(name string, rrdatas []string, ttl int64, rrsType dnsprovider.RrsType) dnsprovider.ResourceRecordSet {
+	return &fakeRRSet{name: name, rrdatas: rrdatas, ttl: ttl, rrsType: rrsType}
+}
+
+func (f *fakeRRSets) StartChangeset() dnsprovider.ResourceRecordChangeset {
+	return &fakeChangeset{rrsets: f}
+}
+
+func (f *fakeRRSets) Zone() dnsprovider.Zone { return nil }
+
+type fakeRRSet struct {
+	name    string
+	rrdatas []string
+	ttl     int64
+	rrsType dnsprovider.RrsType
+}
+
+func (r *fakeRRSet) Name() string              { return r.name }
+func (r *fakeRRSet) Rrdatas() []string         { return r.rrdatas }
+func (r *fakeRRSet) Ttl() int64                { return r.ttl }
+func (r *fakeRRSet) Type() dnsprovider.RrsType { return r.rrsType }
+
+type fakeOp struct {
+	remove bool
+	rrset  dnsprovider.ResourceRecordSet
+}
+
+// fakeChangeset applies its queued ops directly against the fakeRRSets it
+// was started from, the same "only take effect on Apply" contract the real
+// backends implement.
+type fakeChangeset struct {
+	rrsets *fakeRRSets
+	ops    []fakeOp
+}
+
+func (c *fakeChangeset) Add(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, fakeOp{rrset: rrset})
+	return c
+}
+
+func (c *fakeChangeset) Remove(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, fakeOp{remove: true, rrset: rrset})
+	return c
+}
+
+func (c *fakeChangeset) Upsert(rrset dnsprovider.ResourceRecordSet) dnsprovider.ResourceRecordChangeset {
+	c.ops = append(c.ops, fakeOp{rrset: rrset})
+	return c
+}
+
+func (c *fakeChangeset) Apply(ctx context.Context) error {
+	for _, op := range c.ops {
+		if op.remove {
+			delete(c.rrsets.records, op.rrset.Name())
+			continue
+		}
+		c.rrsets.records[op.rrset.Name()] = op.rrset
+	}
+	return nil
+}
+
+const testServiceUUID = "svc-uuid"
+const testDNSSuffix = "cluster1.svcs.example.com"
+
+func setupEndpoints(t *testing.T, eps map[string]db.Endpoint) (db.DB, *fakeRRSets) {
+	t.Helper()
+	dbIns := db.NewMemDB()
+	if err := dbIns.CreateServiceEndpoints(context.Background(), &db.ServiceEndpoints{ServiceUUID: testServiceUUID, Endpoints: eps}); err != nil {
+		t.Fatalf("CreateServiceEndpoints error %s", err)
+	}
+	return dbIns, newFakeRRSets()
+}
+
+// TestReconcileServiceDNSAggregates checks the per-member, per-AZ and
+// global aggregate records a mix of healthy and unhealthy members produces.
+func TestReconcileServiceDNSAggregates(t *testing.T) {
+	dbIns, rrsets := setupEndpoints(t, map[string]db.Endpoint{
+		"member0": {MemberName: "member0", IP: "10.0.0.1", AvailableZone: "az1", Region: "us-west-2", Healthy: true},
+		"member1": {MemberName: "member1", IP: "10.0.0.2", AvailableZone: "az1", Region: "us-west-2", Healthy: true},
+		"member2": {MemberName: "member2", IP: "10.0.0.3", AvailableZone: "az2", Region: "us-west-2", Healthy: false},
+	})
+
+	if err := ReconcileServiceDNS(context.Background(), dbIns, testServiceUUID, testDNSSuffix, &fakeZone{rrsets: rrsets}); err != nil {
+		t.Fatalf("ReconcileServiceDNS error %s", err)
+	}
+
+	member0Name := GenDNSName("member0", testDNSSuffix)
+	if rrs, ok := rrsets.records[member0Name]; !ok || rrs.Rrdatas()[0] != "10.0.0.1" {
+		t.Errorf("expected healthy member0 record %s with IP 10.0.0.1, got %v", member0Name, rrsets.records[member0Name])
+	}
+
+	member2Name := GenDNSName("member2", testDNSSuffix)
+	if _, ok := rrsets.records[member2Name]; ok {
+		t.Errorf("expected no record for unhealthy member2, got %v", rrsets.records[member2Name])
+	}
+
+	az1Name := "az" + dnsNameSeparator + "az1" + dnsNameSeparator + testDNSSuffix
+	az1, ok := rrsets.records[az1Name]
+	if !ok {
+		t.Fatalf("expected az1 aggregate record %s", az1Name)
+	}
+	if len(az1.Rrdatas()) != 2 {
+		t.Errorf("expected 2 IPs in az1 aggregate, got %v", az1.Rrdatas())
+	}
+
+	az2Name := "az" + dnsNameSeparator + "az2" + dnsNameSeparator + testDNSSuffix
+	if _, ok := rrsets.records[az2Name]; ok {
+		t.Errorf("expected no az2 aggregate since its only member is unhealthy, got %v", rrsets.records[az2Name])
+	}
+
+	globalName := GenDNSName(globalAggregateLabel, testDNSSuffix)
+	global, ok := rrsets.records[globalName]
+	if !ok || len(global.Rrdatas()) != 2 {
+		t.Errorf("expected 2-IP global aggregate record, got %v", rrsets.records[globalName])
+	}
+}
+
+// TestReconcileServiceDNSRemovesStaleAggregate checks that a scope's
+// aggregate record is removed, not left stale, once its last healthy member
+// goes unhealthy - the behavior removeRecord exists for.
+func TestReconcileServiceDNSRemovesStaleAggregate(t *testing.T) {
+	dbIns, rrsets := setupEndpoints(t, map[string]db.Endpoint{
+		"member0": {MemberName: "member0", IP: "10.0.0.1", AvailableZone: "az1", Region: "us-west-2", Healthy: true},
+	})
+	zone := &fakeZone{rrsets: rrsets}
+
+	if err := ReconcileServiceDNS(context.Background(), dbIns, testServiceUUID, testDNSSuffix, zone); err != nil {
+		t.Fatalf("ReconcileServiceDNS error %s", err)
+	}
+	globalName := GenDNSName(globalAggregateLabel, testDNSSuffix)
+	if _, ok := rrsets.records[globalName]; !ok {
+		t.Fatalf("expected global aggregate record to exist after first reconcile")
+	}
+
+	eps, err := dbIns.GetServiceEndpoints(context.Background(), testServiceUUID)
+	if err != nil {
+		t.Fatalf("GetServiceEndpoints error %s", err)
+	}
+	member0 := eps.Endpoints["member0"]
+	member0.Healthy = false
+	eps.Endpoints["member0"] = member0
+	if err := dbIns.UpdateServiceEndpoints(context.Background(), testServiceUUID, eps); err != nil {
+		t.Fatalf("UpdateServiceEndpoints error %s", err)
+	}
+
+	if err := ReconcileServiceDNS(context.Background(), dbIns, testServiceUUID, testDNSSuffix, zone); err != nil {
+		t.Fatalf("second ReconcileServiceDNS error %s", err)
+	}
+	if _, ok := rrsets.records[globalName]; ok {
+		t.Errorf("expected global aggregate record to be removed once its last member went unhealthy, got %v", rrsets.records[globalName])
+	}
+}
+
+type fakeZone struct {
+	rrsets *fakeRRSets
+}
+
+func (z *fakeZone) Name() string { return "test-zone" }
+func (z *fakeZone) ID() string   { return "test-zone" }
+func (z *fakeZone) ResourceRecordSets(ctx context.Context) (dnsprovider.ResourceRecordSets, error) {
+	return z.rrsets, nil
+}
@@ -7,6 +7,7 @@ import (
 	"golang.org/x/net/context"
 
 	"github.com/openconnectio/openmanage/common"
+	"github.com/openconnectio/openmanage/dns/dnsprovider"
 	"github.com/openconnectio/openmanage/server"
 )
 
@@ -14,12 +15,16 @@ import (
 // http://docs.aws.amazon.com/Route53/latest/DeveloperGuide/DNSLimitations.html.
 //
 // Would be enough to host all services' members of one cluster in one hosted zone.
-// Every cluster should have its own hosted zone and dns namespace. The customer
-// could create the same services in two clusters, without impacting each other.
-// For one cluster, the default domain name would be cluster-DomainNameSuffix.com,
-// which will be used to create the hosted zone.
+//
+// A hosted zone is a separate concept from a cluster's service dns suffix.
+// The hosted zone (e.g. example.com) is the Route53 zone that is actually
+// delegated to AWS, and could be the customer's existing corporate domain.
+// The service dns suffix (e.g. cluster1.svcs.example.com) is the subdomain
+// under that hosted zone that one cluster's service members are registered
+// under. This lets multiple clusters share a single hosted zone, each under
+// its own subdomain, so the customer only has to delegate NS records once.
 // For one service in the cluster, the dns name of one service member would be
-// serviceMember.cluster-DomainNameSuffix.com. For example, db-0.cluster-scservice.com
+// serviceMember.cluster1.svcs.example.com.
 //
 // AWS VPC belongs to one region. The EC2 instances in different AZs could use the same VPC.
 //
@@ -34,52 +39,104 @@ import (
 // after add vpc1 to the hosted zone2, could nslookup.
 const dnsNameSeparator = "."
 
+// svcsDNSLabel is the subdomain label under which a cluster's service
+// members are registered, so the cluster's suffix does not collide with
+// other records the customer may keep directly under the hosted zone.
+const svcsDNSLabel = "svcs"
+
 // GenDNSName generates the dns name for the service member
 func GenDNSName(svcMemberName string, domainName string) string {
 	return svcMemberName + dnsNameSeparator + domainName
 }
 
-// GenDefaultDomainName generates the default domain name for the cluster
-// example: cluster-openmanage.com
-func GenDefaultDomainName(clusterName string) string {
-	return clusterName + common.NameSeparator + common.DomainNameSuffix + common.DomainSeparator + common.DomainCom
+// GenDefaultHostedZoneName generates the default Route53 hosted zone name,
+// example: openmanage.com
+// The hosted zone is shared by all clusters that delegate to it. A customer
+// could also pass in the name of an existing corporate hosted zone instead.
+func GenDefaultHostedZoneName() string {
+	return common.DomainNameSuffix + common.DomainSeparator + common.DomainCom
 }
 
-// RegisterDNSName registers the dns name
-func RegisterDNSName(ctx context.Context, domainName string, dnsName string, serverInfo server.Info, dnsIns DNS) error {
-	if !strings.HasSuffix(dnsName, domainName) {
+// GenDefaultServiceDNSSuffix generates the default service dns suffix for the
+// cluster, rooted at the given hosted zone.
+// example: cluster.svcs.openmanage.com
+func GenDefaultServiceDNSSuffix(clusterName string, hostedZoneName string) string {
+	return clusterName + dnsNameSeparator + svcsDNSLabel + dnsNameSeparator + hostedZoneName
+}
+
+// defaultRecordTTL is the TTL used for the A record registered by
+// RegisterDNSName.
+const defaultRecordTTL = 60
+
+// RegisterDNSName registers the dns name of a service member against
+// provider. hostedZoneName is the provider zone that serviceDNSSuffix is
+// delegated under, and dnsName must fall under serviceDNSSuffix. opts
+// carries provider-scoped zone creation options (e.g. aws.VPCOptions for a
+// Route53 private zone); callers that do not need any leave it zero-valued.
+func RegisterDNSName(ctx context.Context, hostedZoneName string, serviceDNSSuffix string, dnsName string, serverInfo server.Info, provider dnsprovider.Interface, opts dnsprovider.CreateZoneOptions) error {
+	if !strings.HasSuffix(serviceDNSSuffix, hostedZoneName) {
 		return ErrDomainNotFound
 	}
+	if !strings.HasSuffix(dnsName, serviceDNSSuffix) {
+		return ErrDomainNotFound
+	}
+
+	zones, ok := provider.Zones(ctx)
+	if !ok {
+		return ErrDNSProviderNotSupported
+	}
+
+	zone, err := zones.GetOrCreate(ctx, hostedZoneName, opts)
+	if err != nil {
+		return err
+	}
 
-	private := true
-	vpcID := serverInfo.GetLocalVpcID()
-	vpcRegion := serverInfo.GetLocalRegion()
-	hostedZoneID, err := dnsIns.GetOrCreateHostedZoneIDByName(ctx, domainName, vpcID, vpcRegion, private)
+	rrsets, err := zone.ResourceRecordSets(ctx)
 	if err != nil {
 		return err
 	}
 
 	hostname := serverInfo.GetLocalHostname()
-	return dnsIns.UpdateServiceDNSRecord(ctx, dnsName, hostname, hostedZoneID)
+	rrset := rrsets.New(dnsName, []string{hostname}, defaultRecordTTL, dnsprovider.RrsTypeA)
+
+	changeset := rrsets.StartChangeset()
+	changeset.Upsert(rrset)
+	return changeset.Apply(ctx)
 }
 
-// GetDomainNameFromDNSName extracts the domain name from the dns name.
-// example: aa1.test.com, return test.com
-func GetDomainNameFromDNSName(dnsname string) (string, error) {
+// GetDomainNameFromDNSName extracts the registered hosted zone name from the
+// dns name. As a hosted zone may be a parent of the cluster's service dns
+// suffix rather than the immediate parent of dnsname, this walks up the
+// parent labels, checking each against provider, until it finds one that is
+// actually a registered zone.
+// example: aa1.cluster1.svcs.example.com, with example.com registered as the
+// hosted zone, returns example.com
+func GetDomainNameFromDNSName(ctx context.Context, dnsname string, provider dnsprovider.Interface) (string, error) {
 	names := strings.Split(dnsname, dnsNameSeparator)
 	if len(names) < 3 {
 		return "", ErrDomainNotFound
 	}
-	l := len(names)
-	domain := names[l-2] + dnsNameSeparator + names[l-1]
-	return domain, nil
+
+	zones, ok := provider.Zones(ctx)
+	if !ok {
+		return "", ErrDNSProviderNotSupported
+	}
+
+	for i := 1; i < len(names)-1; i++ {
+		candidate := strings.Join(names[i:], dnsNameSeparator)
+		if _, err := zones.Get(ctx, candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", ErrDomainNotFound
 }
 
 // GetDefaultMgtServiceURL returns the default management service address,
-// example: https://openmanage-manageserver.cluster-openmanage.com:27040/
-func GetDefaultMgtServiceURL(cluster string, tlsEnabled bool) string {
-	domain := GenDefaultDomainName(cluster)
-	dnsname := GenDNSName(common.ManageServiceName, domain)
+// example: https://openmanage-manageserver.cluster.svcs.openmanage.com:27040/
+func GetDefaultMgtServiceURL(cluster string, hostedZoneName string, tlsEnabled bool) string {
+	suffix := GenDefaultServiceDNSSuffix(cluster, hostedZoneName)
+	dnsname := GenDNSName(common.ManageServiceName, suffix)
 	if tlsEnabled {
 		return "https://" + dnsname + ":" + strconv.Itoa(common.ManageHTTPServerPort) + "/"
 	}
@@ -104,9 +161,9 @@ func FormatMgtServiceURL(surl string, tlsEnabled bool) string {
 }
 
 // GetDefaultControlDBAddr returns the default controldb service address,
-// example: openmanage-controldb.cluster-openmanage.com:27030
-func GetDefaultControlDBAddr(cluster string) string {
-	domain := GenDefaultDomainName(cluster)
-	dnsname := GenDNSName(common.ControlDBServiceName, domain)
+// example: openmanage-controldb.cluster.svcs.openmanage.com:27030
+func GetDefaultControlDBAddr(cluster string, hostedZoneName string) string {
+	suffix := GenDefaultServiceDNSSuffix(cluster, hostedZoneName)
+	dnsname := GenDNSName(common.ControlDBServiceName, suffix)
 	return dnsname + ":" + strconv.Itoa(common.ControlDBServerPort)
 }